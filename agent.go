@@ -1,8 +1,12 @@
 package profileagent
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/darshanman/profile-agent/internal"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,19 +21,184 @@ const ErrorGroupUnrecoveredPanics string = "Unrecovered panics"
 //ErrorGroupHandledExceptions ...
 const ErrorGroupHandledExceptions string = "Handled exceptions"
 
-var Histo *prometheus.HistogramVec
+//Profiler - A profiler or reporter that can be switched on and off at runtime.
+type Profiler string
 
-//Options ...
+//ProfilerCPU - CPU profiler.
+const ProfilerCPU = Profiler(internal.ProfilerCPU)
+
+//ProfilerBlock - Block profiler.
+const ProfilerBlock = Profiler(internal.ProfilerBlock)
+
+//ProfilerHeap - Heap allocation profiler.
+const ProfilerHeap = Profiler(internal.ProfilerHeap)
+
+//ProfilerErrors - Error and panic reporter.
+const ProfilerErrors = Profiler(internal.ProfilerErrors)
+
+//ProfilerSegments - Segment reporter.
+const ProfilerSegments = Profiler(internal.ProfilerSegments)
+
+//ProfilerProcess - Process metrics reporter.
+const ProfilerProcess = Profiler(internal.ProfilerProcess)
+
+//QueueDropOldest - QueueDropPolicy that drops the oldest messages to make
+// room in a full queue.
+const QueueDropOldest = internal.QueueDropOldest
+
+//QueueDropNewest - QueueDropPolicy that drops new messages while the queue
+// is full.
+const QueueDropNewest = internal.QueueDropNewest
+
+//OTLPProtocolProtobuf - OTLPProtocol for protobuf encoded OTLP/HTTP requests.
+const OTLPProtocolProtobuf = internal.OTLPProtocolProtobuf
+
+//OTLPProtocolJSON - OTLPProtocol for JSON encoded OTLP/HTTP requests.
+const OTLPProtocolJSON = internal.OTLPProtocolJSON
+
+//Logger - Receives all agent log messages. *slog.Logger satisfies Logger.
+type Logger = internal.Logger
+
+//Exporter - Receives the agent's message queue on every flush. Set
+// Options.Exporter to send messages to a custom backend.
+type Exporter = internal.Exporter
+
+//Message - A queued agent message in version WireVersion of the wire
+// format, e.g. a metric or a profile. See wire.go.
+type Message = internal.Message
+
+//NewSlogLogger - Returns a Logger writing to a log/slog logger.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return internal.NewSlogLogger(logger)
+}
+
+//Options - Agent configuration. See LoadOptions for how values are loaded
+// from a config file and PROFILE_AGENT_* environment variables.
 type Options struct {
-	PromethRoute   string
-	ProxyAddress   string
-	AgentKey       string
-	AppName        string
-	AppVersion     string
-	AppEnvironment string
-	HostName       string
-	Debug          bool
-	ProfileAgent   bool
+	// DEPRECATED. Not used, the agent does not serve metrics itself; serve
+	// Registerer's metrics with promhttp instead.
+	PromethRoute   string `json:"-" yaml:"-"`
+	ProxyAddress   string `json:"proxy_address" yaml:"proxy_address"`
+	AgentKey       string `json:"agent_key" yaml:"agent_key"`
+	AppName        string `json:"app_name" yaml:"app_name"`
+	AppVersion     string `json:"app_version" yaml:"app_version"`
+	AppEnvironment string `json:"app_environment" yaml:"app_environment"`
+	HostName       string `json:"host_name" yaml:"host_name"`
+	Debug          bool   `json:"debug" yaml:"debug"`
+	ProfileAgent   bool   `json:"profile_agent" yaml:"profile_agent"`
+	AdminToken     string `json:"admin_token" yaml:"admin_token"`
+	TopFunctions   *int   `json:"top_functions" yaml:"top_functions"`
+	ConfigFile     string `json:"-" yaml:"-"`
+
+	// DashboardAddress is the URL of the dashboard. If set, queued messages
+	// are uploaded to <DashboardAddress>/agent/v1/upload as gzipped JSON and
+	// the remote configuration is loaded from /agent/v1/config.
+	DashboardAddress string `json:"dashboard_address" yaml:"dashboard_address"`
+
+	// ExportFile receives the exported messages as JSON lines, one message
+	// per line, if Exporter is nil, e.g. on air-gapped hosts. It is rotated
+	// at ExportFileMaxSize bytes (default 16 MB) to <name>-<time><ext>.gz,
+	// keeping the ExportFileMaxFiles newest files (default 10). ReplayFiles
+	// exports the files later.
+	ExportFile         string `json:"export_file" yaml:"export_file"`
+	ExportFileMaxSize  int64  `json:"export_file_max_size" yaml:"export_file_max_size"`
+	ExportFileMaxFiles int    `json:"export_file_max_files" yaml:"export_file_max_files"`
+
+	// HTTPCAFile is a PEM bundle of CAs trusted instead of the system roots
+	// by the dashboard upload and the OTLP, Pushgateway and ingest exporters.
+	// HTTPCertFile and HTTPKeyFile are a PEM client certificate and key for
+	// mutual TLS. HTTPBearerToken and HTTPHeaders are added to every
+	// request. Network errors, 429 and 5xx responses are retried
+	// HTTPMaxRetries times (default 2, Int(0) turns retries off) with jitter
+	// or after Retry-After, within HTTPTimeout (default 20s) per request.
+	HTTPCAFile      string            `json:"http_ca_file" yaml:"http_ca_file"`
+	HTTPCertFile    string            `json:"http_cert_file" yaml:"http_cert_file"`
+	HTTPKeyFile     string            `json:"http_key_file" yaml:"http_key_file"`
+	HTTPBearerToken string            `json:"http_bearer_token" yaml:"http_bearer_token"`
+	HTTPHeaders     map[string]string `json:"http_headers" yaml:"http_headers"`
+	HTTPMaxRetries  *int              `json:"http_max_retries" yaml:"http_max_retries"`
+	HTTPTimeout     Duration          `json:"http_timeout" yaml:"http_timeout"`
+
+	// SpoolDir keeps queued messages on disk until they are exported, so
+	// they survive exporter outages and restarts. The spool is limited to
+	// SpoolMaxSize bytes (default 64 MB), beyond which the oldest messages
+	// are dropped.
+	SpoolDir     string `json:"spool_dir" yaml:"spool_dir"`
+	SpoolMaxSize int64  `json:"spool_max_size" yaml:"spool_max_size"`
+
+	// QueueMaxMessages (default 10000) and QueueMaxSize (default 16 MB of
+	// JSON) limit the in-memory message queue. When it is full,
+	// QueueDropPolicy QueueDropOldest (default) drops the oldest messages
+	// and QueueDropNewest the new ones. QueueBatchSize (default 1000) limits
+	// the messages per export.
+	QueueMaxMessages int    `json:"queue_max_messages" yaml:"queue_max_messages"`
+	QueueMaxSize     int64  `json:"queue_max_size" yaml:"queue_max_size"`
+	QueueDropPolicy  string `json:"queue_drop_policy" yaml:"queue_drop_policy"`
+	QueueBatchSize   int    `json:"queue_batch_size" yaml:"queue_batch_size"`
+
+	// PushgatewayAddress is the URL of a Prometheus Pushgateway. If set, the
+	// agent's metrics are pushed after every process report and on Stop,
+	// grouped by job (AppName) and instance (HostName).
+	PushgatewayAddress string `json:"pushgateway_address" yaml:"pushgateway_address"`
+
+	// OTLPAddress is the base URL of an OTLP/HTTP receiver, e.g.
+	// http://otel-collector:4318. If set, metrics are sent to /v1/metrics
+	// after every process report and on Stop. OTLPProtocol is "http/protobuf"
+	// (default) or "http/json".
+	OTLPAddress  string `json:"otlp_address" yaml:"otlp_address"`
+	OTLPProtocol string `json:"otlp_protocol" yaml:"otlp_protocol"`
+
+	// ProfileDir receives every CPU, block and heap profile as a gzipped
+	// pprof file named <time>_<profiler>_<run ID>.pb.gz. After each write,
+	// files older than ProfileMaxAge (default 7 days) and then the oldest
+	// files beyond a total of ProfileMaxSize bytes (default 100 MB) are removed.
+	ProfileDir     string   `json:"profile_dir" yaml:"profile_dir"`
+	ProfileMaxSize int64    `json:"profile_max_size" yaml:"profile_max_size"`
+	ProfileMaxAge  Duration `json:"profile_max_age" yaml:"profile_max_age"`
+
+	// IngestAddress is the base URL of a continuous profiling ingest API
+	// compatible with Pyroscope, e.g. http://pyroscope:4040. If set, every
+	// CPU, block and heap profile is uploaded in pprof format to /ingest,
+	// named AppName and labeled with hostname, version, environment and
+	// IngestLabels. At most IngestConcurrency uploads (default 2) run at a
+	// time, failed uploads are retried IngestMaxRetries times (default 3,
+	// Int(0) turns retries off).
+	IngestAddress     string            `json:"ingest_address" yaml:"ingest_address"`
+	IngestLabels      map[string]string `json:"ingest_labels" yaml:"ingest_labels"`
+	IngestConcurrency int               `json:"ingest_concurrency" yaml:"ingest_concurrency"`
+	IngestMaxRetries  *int              `json:"ingest_max_retries" yaml:"ingest_max_retries"`
+
+	// StatsDAddress is the host:port of a StatsD server, e.g.
+	// localhost:8125. If set, process metrics, segment timings and error
+	// counts are sent over UDP with StatsDPrefix (default "profileagent"),
+	// batched into packets of at most StatsDMaxPacketSize bytes (default
+	// 1432). StatsDDogStatsD adds app, host, version and env tags and
+	// StatsDTags, e.g. "team:core", and moves segment and error names to tags.
+	StatsDAddress       string   `json:"statsd_address" yaml:"statsd_address"`
+	StatsDPrefix        string   `json:"statsd_prefix" yaml:"statsd_prefix"`
+	StatsDDogStatsD     bool     `json:"statsd_dogstatsd" yaml:"statsd_dogstatsd"`
+	StatsDTags          []string `json:"statsd_tags" yaml:"statsd_tags"`
+	StatsDMaxPacketSize int      `json:"statsd_max_packet_size" yaml:"statsd_max_packet_size"`
+
+	// SegmentBuckets are the buckets of the segment duration histogram in
+	// seconds, prometheus.DefBuckets if empty. SegmentNativeHistogramFactor
+	// above 1, e.g. 1.1, additionally exposes native histograms.
+	SegmentBuckets               []float64 `json:"segment_buckets" yaml:"segment_buckets"`
+	SegmentNativeHistogramFactor float64   `json:"segment_native_histogram_factor" yaml:"segment_native_histogram_factor"`
+
+	// Logger receives agent log messages. If nil, messages are written to
+	// stdout when Debug is set and dropped otherwise.
+	Logger Logger `json:"-" yaml:"-"`
+
+	// Registerer receives the agent's metric collector on Start. If nil,
+	// prometheus.DefaultRegisterer is used. Agents sharing a registerer
+	// need different AppNames.
+	Registerer prometheus.Registerer `json:"-" yaml:"-"`
+
+	// Exporter receives the queued messages on every flush, instead of
+	// ExportFile or the DashboardAddress upload. Failed exports are retried
+	// with a backoff.
+	Exporter Exporter `json:"-" yaml:"-"`
 }
 
 //Agent ...
@@ -44,35 +213,64 @@ type Agent struct {
 	Debug            bool
 }
 
-//NewAgent DEPRECATED. Kept for compatibility with <1.4.3.
-func NewAgent(histo *prometheus.HistogramVec) *Agent {
+//NewAgent - Creates a new, independent agent. Every agent has its own
+// options, reporters, configuration and message queue, so several agents
+// can run in one process.
+func NewAgent() *Agent {
 	a := &Agent{
-		internalAgent: internal.NewAgent(histo),
+		internalAgent: internal.NewAgent(),
 	}
-	Histo = histo
+
 	return a
 }
 
-// Agent instance
+// Default agent instance used by the package-level Start
 var _agent *Agent
+var _agentLock = &sync.Mutex{}
+
+//Start - Starts the default agent with configuration options.
+// Required option is AppName. Use NewAgent to create additional agents.
+func Start(options Options) (*Agent, error) {
+	_agentLock.Lock()
+	defer _agentLock.Unlock()
 
-//Start - Starts the agent with configuration options.
-// Required options are AgentKey and AppName.
-func Start(options Options) *Agent {
 	if _agent == nil {
 		_agent = &Agent{
-			internalAgent: internal.NewAgent(Histo),
+			internalAgent: internal.NewAgent(),
 		}
 	}
 
-	_agent.Start(options)
+	if err := _agent.Start(options); err != nil {
+		return nil, err
+	}
 
-	return _agent
+	return _agent, nil
 }
 
 //Start -  Starts the agent with configuration options.
-// Required options are AgentKey and AppName.
-func (a *Agent) Start(options Options) {
+// Required option is AppName. Options are merged with the config file and
+// environment variables by LoadOptions and validated before the agent starts.
+func (a *Agent) Start(options Options) error {
+	if err := a.applyOptions(options); err != nil {
+		return err
+	}
+
+	a.internalAgent.Start()
+
+	return nil
+}
+
+// applyOptions loads, validates and copies options to the internal agent.
+func (a *Agent) applyOptions(options Options) error {
+	options, err := LoadOptions(options)
+	if err != nil {
+		return err
+	}
+
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
 	a.internalAgent.AgentKey = options.AgentKey
 	a.internalAgent.AppName = options.AppName
 
@@ -88,35 +286,235 @@ func (a *Agent) Start(options Options) {
 		a.internalAgent.HostName = options.HostName
 	}
 
-	if options.PromethRoute != "" {
-		a.internalAgent.PromethRoute = options.PromethRoute
-	}
-
 	if options.ProxyAddress != "" {
 		a.internalAgent.ProxyAddress = options.ProxyAddress
 	}
 
-	if options.Debug {
-		a.internalAgent.Debug = options.Debug
+	a.internalAgent.Debug = options.Debug
+	a.internalAgent.ProfileAgent = options.ProfileAgent
+
+	if options.AdminToken != "" {
+		a.internalAgent.AdminToken = options.AdminToken
 	}
 
-	if options.ProfileAgent {
-		a.internalAgent.ProfileAgent = options.ProfileAgent
+	if options.TopFunctions != nil {
+		a.internalAgent.TopFunctions = *options.TopFunctions
 	}
 
-	a.internalAgent.Start()
+	if len(options.SegmentBuckets) > 0 {
+		a.internalAgent.SegmentBuckets = options.SegmentBuckets
+	}
+
+	if options.DashboardAddress != "" {
+		a.internalAgent.DashboardAddress = options.DashboardAddress
+	}
+
+	if options.SpoolDir != "" {
+		a.internalAgent.SpoolDir = options.SpoolDir
+	}
+
+	if options.SpoolMaxSize > 0 {
+		a.internalAgent.SpoolMaxSize = options.SpoolMaxSize
+	}
+
+	if options.QueueMaxMessages > 0 {
+		a.internalAgent.QueueMaxMessages = options.QueueMaxMessages
+	}
+
+	if options.QueueMaxSize > 0 {
+		a.internalAgent.QueueMaxSize = options.QueueMaxSize
+	}
+
+	if options.QueueDropPolicy != "" {
+		a.internalAgent.QueueDropPolicy = options.QueueDropPolicy
+	}
+
+	if options.QueueBatchSize > 0 {
+		a.internalAgent.QueueBatchSize = options.QueueBatchSize
+	}
+
+	if options.PushgatewayAddress != "" {
+		a.internalAgent.PushgatewayAddress = options.PushgatewayAddress
+	}
+
+	if options.OTLPAddress != "" {
+		a.internalAgent.OTLPAddress = options.OTLPAddress
+	}
+
+	if options.OTLPProtocol != "" {
+		a.internalAgent.OTLPProtocol = options.OTLPProtocol
+	}
+
+	if options.ProfileDir != "" {
+		a.internalAgent.ProfileDir = options.ProfileDir
+	}
+
+	if options.ProfileMaxSize > 0 {
+		a.internalAgent.ProfileMaxSize = options.ProfileMaxSize
+	}
+
+	if options.ProfileMaxAge > 0 {
+		a.internalAgent.ProfileMaxAge = time.Duration(options.ProfileMaxAge)
+	}
+
+	if options.IngestAddress != "" {
+		a.internalAgent.IngestAddress = options.IngestAddress
+	}
+
+	if len(options.IngestLabels) > 0 {
+		a.internalAgent.IngestLabels = options.IngestLabels
+	}
+
+	if options.IngestConcurrency > 0 {
+		a.internalAgent.IngestConcurrency = options.IngestConcurrency
+	}
+
+	if options.IngestMaxRetries != nil {
+		a.internalAgent.IngestMaxRetries = *options.IngestMaxRetries
+	}
+
+	if options.ExportFile != "" {
+		a.internalAgent.ExportFile = options.ExportFile
+	}
+
+	if options.ExportFileMaxSize > 0 {
+		a.internalAgent.ExportFileMaxSize = options.ExportFileMaxSize
+	}
+
+	if options.ExportFileMaxFiles > 0 {
+		a.internalAgent.ExportFileMaxFiles = options.ExportFileMaxFiles
+	}
+
+	if options.HTTPCAFile != "" {
+		a.internalAgent.HTTPCAFile = options.HTTPCAFile
+	}
+
+	if options.HTTPCertFile != "" {
+		a.internalAgent.HTTPCertFile = options.HTTPCertFile
+	}
+
+	if options.HTTPKeyFile != "" {
+		a.internalAgent.HTTPKeyFile = options.HTTPKeyFile
+	}
+
+	if options.HTTPBearerToken != "" {
+		a.internalAgent.HTTPBearerToken = options.HTTPBearerToken
+	}
+
+	if len(options.HTTPHeaders) > 0 {
+		a.internalAgent.HTTPHeaders = options.HTTPHeaders
+	}
+
+	if options.HTTPMaxRetries != nil {
+		a.internalAgent.HTTPMaxRetries = *options.HTTPMaxRetries
+	}
+
+	if options.HTTPTimeout > 0 {
+		a.internalAgent.HTTPTimeout = time.Duration(options.HTTPTimeout)
+	}
+
+	if options.StatsDAddress != "" {
+		a.internalAgent.StatsDAddress = options.StatsDAddress
+	}
+
+	if options.StatsDPrefix != "" {
+		a.internalAgent.StatsDPrefix = options.StatsDPrefix
+	}
+
+	a.internalAgent.StatsDDogStatsD = options.StatsDDogStatsD
+
+	if len(options.StatsDTags) > 0 {
+		a.internalAgent.StatsDTags = options.StatsDTags
+	}
+
+	if options.StatsDMaxPacketSize > 0 {
+		a.internalAgent.StatsDMaxPacketSize = options.StatsDMaxPacketSize
+	}
+
+	if options.SegmentNativeHistogramFactor != 0 {
+		a.internalAgent.SegmentNativeHistogramFactor = options.SegmentNativeHistogramFactor
+	}
+
+	if options.Logger != nil {
+		a.internalAgent.Logger = options.Logger
+	}
+
+	if options.Registerer != nil {
+		a.internalAgent.Registerer = options.Registerer
+	}
+
+	if options.Exporter != nil {
+		a.internalAgent.Exporter = options.Exporter
+	}
+
+	return nil
+}
+
+//ReplayFiles - Exports the messages of files written with ExportFile, e.g.
+// copied from an air-gapped host, with Options.Exporter or else to
+// DashboardAddress. ExportFile is never replayed to and, being the file the
+// agent writes, cannot be replayed. Options are loaded and validated as by
+// Start, but no agent is started. Returns the number of exported messages; on
+// error, messages exported before are not rolled back.
+func ReplayFiles(ctx context.Context, options Options, fileNames ...string) (int, error) {
+	a := NewAgent()
+	if err := a.applyOptions(options); err != nil {
+		return 0, err
+	}
+
+	return a.internalAgent.ReplayFiles(ctx, fileNames...)
+}
+
+//Stop - Stops the agent. Reporters are stopped, in-flight profiler runs are
+// awaited, collected data is reported one last time and the message queue is
+// flushed. Stop returns ctx.Err() if ctx is done before the final flush completes;
+// the shutdown then continues in the background and a later Start waits for it.
+func (a *Agent) Stop(ctx context.Context) error {
+	return a.internalAgent.Stop(ctx)
+}
+
+//PauseProfiling - Pauses the CPU, block and heap profilers. Errors, segments
+// and process metrics are still reported.
+func (a *Agent) PauseProfiling() {
+	a.internalAgent.PauseProfiling()
+}
+
+//ResumeProfiling - Resumes profilers paused by PauseProfiling.
+func (a *Agent) ResumeProfiling() {
+	a.internalAgent.ResumeProfiling()
+}
+
+//SetProfilerEnabled - Switches a single profiler or reporter on or off at runtime.
+func (a *Agent) SetProfilerEnabled(profiler Profiler, enabled bool) error {
+	return a.internalAgent.SetProfilerEnabled(string(profiler), enabled)
+}
+
+//IsProfilerEnabled - Tells if a profiler or reporter is switched on.
+func (a *Agent) IsProfilerEnabled(profiler Profiler) bool {
+	return a.internalAgent.IsProfilerEnabled(string(profiler))
+}
+
+//AdminHandler - Returns an http.Handler with agent status and controls. Mount
+// it under a prefix with http.StripPrefix. The status, pause, resume, profiler
+// switches, interval changes and captures require
+// "Authorization: Bearer <AdminToken>" and are refused if AdminToken is empty.
+func (a *Agent) AdminHandler() http.Handler {
+	return a.internalAgent.AdminHandler()
 }
 
 //Configure - DEPRECATED. Kept for compatibility with <1.2.0.
 func (a *Agent) Configure(agentKey string, appName string) {
-	a.Start(Options{
-		AgentKey:     agentKey,
-		AppName:      appName,
-		HostName:     a.HostName,
-		PromethRoute: "/metrics",
-		// DashboardAddress: a.DashboardAddress,
-		Debug: a.Debug,
+	err := a.Start(Options{
+		AgentKey:         agentKey,
+		AppName:          appName,
+		HostName:         a.HostName,
+		DashboardAddress: a.DashboardAddress,
+		Debug:            a.Debug,
 	})
+	if err != nil {
+		a.internalAgent.Debug = a.Debug
+		a.internalAgent.LogError(err)
+	}
 }
 
 //MeasureSegment  Starts measurement of execution time of a code segment.
@@ -124,31 +522,54 @@ func (a *Agent) Configure(agentKey string, appName string) {
 // After calling Stop the segment is recorded, aggregated and
 // reported with regular intervals.
 func (a *Agent) MeasureSegment(segmentName string) *Segment {
-	s := newSegment(a, segmentName)
+	s := newSegment(a, nil, segmentName)
 	s.start()
 
 	return s
 }
 
+//MeasureSegmentContext - Starts measurement of execution time of a code segment
+// nested under the segment carried by ctx, if any. Segments started with the
+// returned context become children of this segment and are reported as a tree,
+// each level with its own 95th percentile. To stop measurement call Stop on
+// the returned Segment object.
+func (a *Agent) MeasureSegmentContext(ctx context.Context, segmentName string) (context.Context, *Segment) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	parent := segmentFromContext(ctx)
+	if parent != nil && parent.agent != a {
+		parent = nil
+	}
+
+	s := newSegment(a, parent, segmentName)
+	s.start()
+
+	return context.WithValue(ctx, segmentContextKey{}, s), s
+}
+
 //MeasureHandlerFunc - A helper function to measure HTTP handler function execution
-// by wrapping http.HandleFunc method parameters.
+// by wrapping http.HandleFunc method parameters. Segments measured with
+// MeasureSegmentContext and the request context are nested under the handler segment.
 func (a *Agent) MeasureHandlerFunc(pattern string, handlerFunc func(http.ResponseWriter, *http.Request)) (string, func(http.ResponseWriter, *http.Request)) {
 	return pattern, func(w http.ResponseWriter, r *http.Request) {
-		segment := a.MeasureSegment(fmt.Sprintf("Handler %s", pattern))
+		ctx, segment := a.MeasureSegmentContext(r.Context(), fmt.Sprintf("Handler %s", pattern))
 		defer segment.Stop()
 
-		handlerFunc(w, r)
+		handlerFunc(w, r.WithContext(ctx))
 	}
 }
 
 //MeasureHandler - A helper function to measure HTTP handler execution
-// by wrapping http.Handle method parameters.
+// by wrapping http.Handle method parameters. Segments measured with
+// MeasureSegmentContext and the request context are nested under the handler segment.
 func (a *Agent) MeasureHandler(pattern string, handler http.Handler) (string, http.Handler) {
 	return pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		segment := a.MeasureSegment(fmt.Sprintf("Handler %s", pattern))
+		ctx, segment := a.MeasureSegmentContext(r.Context(), fmt.Sprintf("Handler %s", pattern))
 		defer segment.Stop()
 
-		handler.ServeHTTP(w, r)
+		handler.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
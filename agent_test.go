@@ -1,11 +1,15 @@
 package profileagent
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -13,21 +17,18 @@ import (
 func TestMeasureSegment(t *testing.T) {
 	agent := NewAgent()
 
-	done1 := make(chan bool)
+	done1 := make(chan *Segment)
 
-	var seg1 *Segment
 	go func() {
-		seg1 = agent.MeasureSegment("seg1")
-		defer seg1.Stop()
+		seg1 := agent.MeasureSegment("seg1")
 
 		time.Sleep(50 * time.Millisecond)
 
-		done1 <- true
+		seg1.Stop()
+		done1 <- seg1
 	}()
 
-	<-done1
-
-	time.Sleep(10 * time.Millisecond)
+	seg1 := <-done1
 
 	if seg1.Duration < 50 {
 		t.Errorf("Duration of seg1 is too low: %v", seg1.Duration)
@@ -155,3 +156,58 @@ func BenchmarkRecordError(b *testing.B) {
 	// go test -v -run=^$ -bench=BenchmarkRecordError -cpuprofile=cpu.out
 	// go tool pprof internal.test cpu.out
 }
+
+func TestMeasureSegmentContext(t *testing.T) {
+	agent := NewAgent()
+
+	ctx, seg1 := agent.MeasureSegmentContext(context.Background(), "seg1")
+	_, seg2 := agent.MeasureSegmentContext(ctx, "seg2")
+
+	time.Sleep(10 * time.Millisecond)
+
+	seg2.Stop()
+	seg1.Stop()
+
+	if len(seg2.path) != 2 || seg2.path[0] != "seg1" || seg2.path[1] != "seg2" {
+		t.Errorf("seg2 should be nested under seg1, but has path %v", seg2.path)
+	}
+
+	if seg1.Duration < seg2.Duration {
+		t.Errorf("Duration of seg1 should not be lower than seg2: %v < %v", seg1.Duration, seg2.Duration)
+	}
+}
+
+type collectExporter struct {
+	messages []Message
+}
+
+func (ce *collectExporter) Export(ctx context.Context, messages []Message) error {
+	ce.messages = append(ce.messages, messages...)
+	return nil
+}
+
+func TestReplayFiles(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "messages.jsonl")
+
+	data := ""
+	for i := 0; i < 3; i++ {
+		line, _ := json.Marshal(Message{Version: WireVersion, Topic: TopicMetric, AddedAt: int64(i)})
+		data += string(line) + "\n"
+	}
+	if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := &collectExporter{}
+	n, err := ReplayFiles(context.Background(), Options{AppName: "App1", Exporter: exporter}, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || len(exporter.messages) != 3 || exporter.messages[2].AddedAt != 2 {
+		t.Errorf("Expected 3 replayed messages, got %v: %v", n, exporter.messages)
+	}
+
+	if _, err := ReplayFiles(context.Background(), Options{Exporter: exporter}, fileName); err == nil {
+		t.Errorf("Replay with invalid options should fail")
+	}
+}
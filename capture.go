@@ -0,0 +1,52 @@
+package profileagent
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+//CaptureCPUProfile - Takes a CPU profile of the given duration and returns it
+// as gzipped pprof data, readable by go tool pprof. The capture waits for
+// scheduled profiler runs and never overlaps with them. It returns ctx.Err()
+// if ctx is done before the profile is taken.
+func (a *Agent) CaptureCPUProfile(ctx context.Context, duration time.Duration) ([]byte, error) {
+	p, err := a.internalAgent.CaptureCPUProfile(ctx, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeProfile(p)
+}
+
+//CaptureBlockProfile - Enables block profiling for the given duration and
+// returns the block profile as gzipped pprof data.
+func (a *Agent) CaptureBlockProfile(ctx context.Context, duration time.Duration) ([]byte, error) {
+	p, err := a.internalAgent.CaptureBlockProfile(ctx, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeProfile(p)
+}
+
+//CaptureHeapProfile - Returns the current heap profile as gzipped pprof data.
+func (a *Agent) CaptureHeapProfile(ctx context.Context) ([]byte, error) {
+	p, err := a.internalAgent.CaptureHeapProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeProfile(p)
+}
+
+func writeProfile(p *profile.Profile) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
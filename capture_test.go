@@ -0,0 +1,29 @@
+package profileagent
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+func TestCaptureHeapProfile(t *testing.T) {
+	agent := NewAgent()
+
+	data, err := agent.CaptureHeapProfile(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Errorf("Captured data is not a valid pprof profile: %v", err)
+		return
+	}
+
+	if len(p.SampleType) == 0 {
+		t.Error("Heap profile should have sample types")
+	}
+}
@@ -280,13 +280,17 @@ func SimulateErrors() {
 
 func profilemain() {
 	// StackImpact initialization
-	agent2 = profileagent.Start(profileagent.Options{
+	var err error
+	agent2, err = profileagent.Start(profileagent.Options{
 		AgentKey:   os.Getenv("AGENT_KEY"),
 		AppName:    "ExampleGoApp",
 		AppVersion: "1.0.0",
 		// DashboardAddress: os.Getenv("DASHBOARD_ADDRESS"), // test only
 		Debug: false,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	// end StackImpact initialization
 
 	go SimulateCPUUsage()
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
 
 	profileagent "github.com/darshanman/profile-agent"
 	"github.com/darshanman/profile-agent/examples"
@@ -12,47 +17,81 @@ import (
 
 var agent *profileagent.Agent
 
-var buckets = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.75, 1}
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayFunc(os.Args[2:])
+		return
+	}
+
 	startFunc()
 }
 
+// replayFunc exports files written with ExportFile, oldest file first, to
+// the exporter selected with -exporter: "dashboard" uploads them to
+// PROFILE_AGENT_DASHBOARD_ADDRESS, "stdout" writes them as JSON lines to
+// stdout, e.g. to pipe them into another tool.
+//   PROFILE_AGENT_DASHBOARD_ADDRESS=https://dashboard executable replay messages*.jsonl*
+//   executable replay -exporter stdout messages*.jsonl* | jq .metric.name
+func replayFunc(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	exporterName := flags.String("exporter", "dashboard", "exporter to replay to: dashboard or stdout")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		log.Fatal("usage: executable replay [-exporter dashboard|stdout] <file>...")
+	}
+
+	options := profileagent.Options{
+		AppName:    "ExampleGoApp",
+		AppVersion: "1.0.0",
+	}
+
+	switch *exporterName {
+	case "dashboard":
+	case "stdout":
+		options.Exporter = &stdoutExporter{encoder: json.NewEncoder(os.Stdout)}
+	default:
+		log.Fatalf("Unknown exporter %q, use dashboard or stdout", *exporterName)
+	}
+
+	n, err := profileagent.ReplayFiles(context.Background(), options, flags.Args()...)
+	if err != nil {
+		log.Fatalf("Replayed %v messages: %v", n, err)
+	}
+
+	log.Printf("Replayed %v messages", n)
+}
+
+// stdoutExporter writes messages as JSON lines, like ExportFile.
+type stdoutExporter struct {
+	encoder *json.Encoder
+}
+
+func (se *stdoutExporter) Export(ctx context.Context, messages []profileagent.Message) error {
+	for _, m := range messages {
+		if err := se.encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func startFunc() {
-	histo := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: "profileagent_example",
-		Name:      "memory_histo_sample",
-		Help:      "memory histogram vec",
-		Buckets:   buckets,
-	}, []string{
-		"measuremntValue",
-		"measuremntDuration",
-		"measuremntTimestamp",
-		"breakdown",
-	})
-	prometheus.MustRegister(
-		histo,
-	)
 	if agent == nil {
-		agent = profileagent.NewAgent(histo)
+		agent = profileagent.NewAgent()
 	}
-	agent = profileagent.Start(profileagent.Options{
+	err := agent.Start(profileagent.Options{
 
 		AppName:    "ExampleGoApp",
 		AppVersion: "1.0.0",
 		// DashboardAddress: os.Getenv("DASHBOARD_ADDRESS"), // test only
+		// ExportFile: "/var/lib/example/messages.jsonl", // replay with "executable replay"
 		Debug: false,
 	})
-
-	// start := time.Now()
-	// histo.WithLabelValues(
-	// 	"m.id",
-	// 	"m.measurement.value",
-	// 	"m.measurement.duration",
-	// 	"m.measurement.timestamp",
-	// 	"m.typ",
-	// 	"name",
-	// ).Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	http.HandleFunc(agent.MeasureHandlerFunc("/measure-func", func(w http.ResponseWriter, r *http.Request) {
 		// s := make([]string, 0)
@@ -79,7 +118,10 @@ func startFunc() {
 	// 	}
 	// 	fmt.Fprintf(w, "some-func")
 	// })
-	http.Handle("/metrics", promhttp.Handler())
+	// OpenMetrics exposes the exemplars linking series to profiles
+	http.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
 
 	http.ListenAndServe(":8081", nil)
 }
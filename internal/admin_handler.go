@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+const defaultCaptureDuration = 10 * time.Second
+const maxCaptureDuration = 5 * time.Minute
+
+//AdminHandler ...
+type AdminHandler struct {
+	agent *Agent
+	mux   *http.ServeMux
+}
+
+func newAdminHandler(agent *Agent) *AdminHandler {
+	ah := &AdminHandler{
+		agent: agent,
+		mux:   http.NewServeMux(),
+	}
+
+	ah.mux.HandleFunc("/status", ah.authorize(http.MethodGet, ah.handleStatus))
+	ah.mux.HandleFunc("/pause", ah.authorize(http.MethodPost, ah.handlePause))
+	ah.mux.HandleFunc("/resume", ah.authorize(http.MethodPost, ah.handleResume))
+	ah.mux.HandleFunc("/profilers", ah.authorize(http.MethodPost, ah.handleProfilers))
+	ah.mux.HandleFunc("/intervals", ah.authorize(http.MethodPost, ah.handleIntervals))
+	ah.mux.HandleFunc("/capture/", ah.authorize(http.MethodPost, ah.handleCapture))
+
+	return ah
+}
+
+//AdminHandler returns an http.Handler with agent status and controls. Routes
+// are relative, mount it with http.StripPrefix:
+//   GET  /status                                      agent status
+//   POST /pause, /resume                              pause or resume profiling
+//   POST /profilers?profiler=cpu&enabled=false        switch a profiler
+//   POST /intervals?profiler=cpu&record_interval=10s&record_duration=2s&report_interval=2m
+//   POST /capture/{cpu,block,heap}?duration=10s       capture a pprof profile
+// All routes require the "Authorization: Bearer <AdminToken>" header and are
+// disabled if AdminToken is empty, since the status reveals build and run IDs.
+func (a *Agent) AdminHandler() http.Handler {
+	return a.adminHandler
+}
+
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ah.mux.ServeHTTP(w, r)
+}
+
+func (ah *AdminHandler) authorize(method string, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := ah.agent.AdminToken
+		if token == "" {
+			http.Error(w, "Admin handler is disabled, no admin token is configured", http.StatusForbidden)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handlerFunc(w, r)
+	}
+}
+
+func (ah *AdminHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	a := ah.agent
+
+	profilers := make([]map[string]interface{}, 0, len(Profilers))
+	for _, name := range Profilers {
+		p := map[string]interface{}{
+			"name":           name,
+			"enabled":        a.config.isProfilerEnabled(name),
+			"last_report_at": a.stats.readLastReport(name),
+		}
+
+		if ps := ah.scheduler(name); ps != nil {
+			recordInterval, recordDuration, reportInterval := ps.readIntervals()
+			if ps.recordFunc != nil {
+				p["record_interval"] = (time.Duration(recordInterval) * time.Millisecond).String()
+				p["record_duration"] = (time.Duration(recordDuration) * time.Millisecond).String()
+			}
+			p["report_interval"] = (time.Duration(reportInterval) * time.Millisecond).String()
+		}
+
+		profilers = append(profilers, p)
+	}
+
+	lastExportError, lastExportErrorTs := a.stats.readLastExportError()
+
+	status := map[string]interface{}{
+		"agent_version":        AgentVersion,
+		"app_name":             a.AppName,
+		"app_version":          a.AppVersion,
+		"app_environment":      a.AppEnvironment,
+		"host_name":            a.HostName,
+		"run_id":               a.runID,
+		"build_id":             a.buildID,
+		"run_ts":               a.runTs,
+		"started":              a.isStarted(),
+		"profiling_paused":     a.config.isProfilingPaused(),
+		"profiling_disabled":   a.config.isProfilingDisabled(),
+		"profilers":            profilers,
+		"queue_size":           a.messageQueue.size(),
+		"queue_dropped":        a.stats.readQueueDropped(),
+		"queue_retried":        a.stats.readQueueRetried(),
+		"spool_dropped":        a.messageSpool.readDropped(),
+		"export_failures":      a.stats.readExportFailures(),
+		"last_export_error":    lastExportError,
+		"last_export_error_at": lastExportErrorTs,
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (ah *AdminHandler) handlePause(w http.ResponseWriter, r *http.Request) {
+	ah.agent.PauseProfiling()
+	ah.handleStatus(w, r)
+}
+
+func (ah *AdminHandler) handleResume(w http.ResponseWriter, r *http.Request) {
+	ah.agent.ResumeProfiling()
+	ah.handleStatus(w, r)
+}
+
+func (ah *AdminHandler) handleProfilers(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled value", http.StatusBadRequest)
+		return
+	}
+
+	if err := ah.agent.SetProfilerEnabled(r.FormValue("profiler"), enabled); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ah.handleStatus(w, r)
+}
+
+func (ah *AdminHandler) handleIntervals(w http.ResponseWriter, r *http.Request) {
+	ps := ah.scheduler(r.FormValue("profiler"))
+	if ps == nil {
+		http.Error(w, "Profiler must be one of cpu, block, heap", http.StatusBadRequest)
+		return
+	}
+
+	recordInterval, recordDuration, reportInterval := ps.readIntervals()
+
+	values := map[string]*int64{
+		"record_interval": &recordInterval,
+		"record_duration": &recordDuration,
+		"report_interval": &reportInterval,
+	}
+	for key, value := range values {
+		if s := r.FormValue(key); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %v: %v", key, err), http.StatusBadRequest)
+				return
+			}
+			*value = int64(d / time.Millisecond)
+		}
+	}
+
+	if err := ps.setIntervals(recordInterval, recordDuration, reportInterval); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ah.agent.info("Profiler %v intervals changed.", ps.name)
+	ah.handleStatus(w, r)
+}
+
+func (ah *AdminHandler) handleCapture(w http.ResponseWriter, r *http.Request) {
+	duration := defaultCaptureDuration
+	if s := r.FormValue("duration"); s != "" {
+		var err error
+		if duration, err = time.ParseDuration(s); err != nil || duration <= 0 || duration > maxCaptureDuration {
+			http.Error(w, fmt.Sprintf("Duration must be between 0 and %v", maxCaptureDuration), http.StatusBadRequest)
+			return
+		}
+	}
+
+	kind := strings.TrimPrefix(r.URL.Path, "/capture/")
+
+	var p *profile.Profile
+	var err error
+	switch kind {
+	case ProfilerCPU:
+		p, err = ah.agent.CaptureCPUProfile(r.Context(), duration)
+	case ProfilerBlock:
+		p, err = ah.agent.CaptureBlockProfile(r.Context(), duration)
+	case ProfilerHeap:
+		p, err = ah.agent.CaptureHeapProfile(r.Context())
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v-%v.pb.gz\"", kind, time.Now().Unix()))
+	w.Write(buf.Bytes())
+}
+
+func (ah *AdminHandler) scheduler(profiler string) *ProfilerScheduler {
+	switch profiler {
+	case ProfilerCPU:
+		return ah.agent.cpuReporter.profilerScheduler
+	case ProfilerBlock:
+		return ah.agent.blockReporter.profilerScheduler
+	case ProfilerHeap:
+		return ah.agent.allocationReporter.profilerScheduler
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
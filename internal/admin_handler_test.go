@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+func adminRequest(agent *Agent, method string, target string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	agent.AdminHandler().ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestAdminStatus(t *testing.T) {
+	agent := NewAgent()
+	agent.AppName = "test-app"
+	agent.stats.recordReport(ProfilerCPU)
+
+	if rec := adminRequest(agent, "GET", "/status", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Status without admin token should be forbidden, but returned %v", rec.Code)
+	}
+
+	agent.AdminToken = "secret"
+
+	if rec := adminRequest(agent, "GET", "/status", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Status with wrong token should be unauthorized, but returned %v", rec.Code)
+	}
+
+	rec := adminRequest(agent, "GET", "/status", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Status should return 200, but returned %v", rec.Code)
+	}
+
+	var status struct {
+		AgentVersion string `json:"agent_version"`
+		AppName      string `json:"app_name"`
+		RunID        string `json:"run_id"`
+		BuildID      string `json:"build_id"`
+		Profilers    []struct {
+			Name           string `json:"name"`
+			Enabled        bool   `json:"enabled"`
+			LastReportAt   int64  `json:"last_report_at"`
+			RecordInterval string `json:"record_interval"`
+		} `json:"profilers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.AgentVersion != AgentVersion || status.AppName != "test-app" || status.RunID != agent.runID || status.BuildID != agent.buildID {
+		t.Errorf("Invalid status: %+v", status)
+	}
+
+	if len(status.Profilers) != len(Profilers) {
+		t.Fatalf("Status should list %v profilers, but listed %v", len(Profilers), len(status.Profilers))
+	}
+
+	cpu := status.Profilers[0]
+	if cpu.Name != ProfilerCPU || !cpu.Enabled || cpu.LastReportAt == 0 || cpu.RecordInterval != "10s" {
+		t.Errorf("Invalid CPU profiler status: %+v", cpu)
+	}
+}
+
+func TestAdminControlToken(t *testing.T) {
+	agent := NewAgent()
+
+	if rec := adminRequest(agent, "POST", "/pause", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Control should be disabled without a token, but returned %v", rec.Code)
+	}
+
+	agent.AdminToken = "secret"
+
+	if rec := adminRequest(agent, "POST", "/pause", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Control should refuse a wrong token, but returned %v", rec.Code)
+	}
+
+	if rec := adminRequest(agent, "GET", "/pause", "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Control should require POST, but returned %v", rec.Code)
+	}
+
+	if rec := adminRequest(agent, "POST", "/pause", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("Pause should return 200, but returned %v", rec.Code)
+	}
+	if !agent.IsProfilingPaused() {
+		t.Error("Profiling should be paused")
+	}
+
+	if rec := adminRequest(agent, "POST", "/resume", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("Resume should return 200, but returned %v", rec.Code)
+	}
+	if agent.IsProfilingPaused() {
+		t.Error("Profiling should be resumed")
+	}
+
+	if rec := adminRequest(agent, "POST", "/profilers?profiler=block&enabled=false", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("Profiler switch should return 200, but returned %v", rec.Code)
+	}
+	if agent.IsProfilerEnabled(ProfilerBlock) {
+		t.Error("Block profiler should be disabled")
+	}
+
+	if rec := adminRequest(agent, "POST", "/profilers?profiler=unknown&enabled=false", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Unknown profiler should return 400, but returned %v", rec.Code)
+	}
+}
+
+func TestAdminIntervals(t *testing.T) {
+	agent := NewAgent()
+	agent.AdminToken = "secret"
+
+	rec := adminRequest(agent, "POST", "/intervals?profiler=heap&report_interval=30s", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Intervals should return 200, but returned %v: %v", rec.Code, rec.Body.String())
+	}
+
+	if _, _, reportInterval := agent.allocationReporter.profilerScheduler.readIntervals(); reportInterval != 30000 {
+		t.Errorf("Report interval should be 30000, but is %v", reportInterval)
+	}
+
+	rec = adminRequest(agent, "POST", "/intervals?profiler=cpu&record_interval=1s&record_duration=5s", "secret")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Record duration longer than interval should return 400, but returned %v", rec.Code)
+	}
+}
+
+func TestAdminCapture(t *testing.T) {
+	agent := NewAgent()
+	agent.AdminToken = "secret"
+
+	rec := adminRequest(agent, "POST", "/capture/heap", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Capture should return 200, but returned %v: %v", rec.Code, rec.Body.String())
+	}
+
+	if _, err := profile.Parse(rec.Body); err != nil {
+		t.Errorf("Capture should return a pprof profile: %v", err)
+	}
+
+	if rec := adminRequest(agent, "POST", "/capture/cpu?duration=1h", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Too long capture should return 400, but returned %v", rec.Code)
+	}
+}
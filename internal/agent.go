@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -21,27 +23,50 @@ const AgentVersion = "2.0.1"
 //DefaultPromethRoute ...
 const DefaultPromethRoute = "/metrics"
 
-var agentStarted bool
+//DefaultTopFunctions is the number of hot functions exported per profiler
+// and scope.
+const DefaultTopFunctions = 10
+
+//profilerLock is shared by all agents in the process. CPU profiling
+// (pprof.StartCPUProfile) and the block profile rate
+// (runtime.SetBlockProfileRate) are process-wide, so record and report runs
+// of every agent instance are serialized on this lock. Each agent receives its
+// own copy of the resulting profile, which covers the whole process.
+var profilerLock = newProfilerLock()
 
 //Agent ...
 type Agent struct {
-	nextID  int64
-	buildID string
-	runID   string
-	runTs   int64
+	started   int32
+	startLock *sync.Mutex
+	nextID    int64
+	buildID   string
+	runID     string
+	runTs     int64
 
 	apiRequest         *APIRequest
 	config             *Config
 	configLoader       *ConfigLoader
 	messageQueue       *MessageQueue
+	messageSpool       *MessageSpool
 	processReporter    *ProcessReporter
 	cpuReporter        *CPUReporter
 	allocationReporter *AllocationReporter
 	blockReporter      *BlockReporter
 	segmentReporter    *SegmentReporter
 	errorReporter      *ErrorReporter
-
-	profilerLock *sync.Mutex
+	stats              *AgentStats
+	adminHandler       *AdminHandler
+	metricCollector    *MetricCollector
+	pushgatewayPusher  *PushgatewayPusher
+	httpExporter       *HTTPExporter
+	otlpExporter       *OTLPExporter
+	profileFileSink    *ProfileFileSink
+	ingestUploader     *IngestUploader
+	statsdExporter     *StatsDExporter
+	fileExporter       *FileExporter
+	httpClient         *HTTPClient
+
+	profilerLock *ProfilerLock
 
 	// Options
 	PromethRoute   string
@@ -53,28 +78,123 @@ type Agent struct {
 	HostName       string
 	Debug          bool
 	ProfileAgent   bool
+	AdminToken     string
+	TopFunctions   int
+	Logger         Logger
+	Registerer     prometheus.Registerer
+
+	// Exporter receives the flushed message queue. If nil, messages are
+	// written to ExportFile with FileExporter, if set, or uploaded with
+	// HTTPExporter if DashboardAddress is set.
+	DashboardAddress string
+	Exporter         Exporter
+
+	// SpoolDir keeps queued messages on disk until they are exported, up to
+	// SpoolMaxSize bytes. Spooled messages do not expire and are replayed
+	// after a restart.
+	SpoolDir     string
+	SpoolMaxSize int64
+
+	// QueueMaxMessages and QueueMaxSize limit the in-memory message queue.
+	// QueueDropPolicy is QueueDropOldest or QueueDropNewest. QueueBatchSize
+	// limits the messages per export.
+	QueueMaxMessages int
+	QueueMaxSize     int64
+	QueueDropPolicy  string
+	QueueBatchSize   int
+
+	// ExportFile receives the exported messages as JSON lines if there is
+	// no Exporter, rotated at ExportFileMaxSize bytes and gzipped, keeping
+	// ExportFileMaxFiles rotated files.
+	ExportFile         string
+	ExportFileMaxSize  int64
+	ExportFileMaxFiles int
+
+	// HTTPCAFile, HTTPCertFile and HTTPKeyFile configure TLS of the
+	// HTTPClient used by exporters, HTTPBearerToken and HTTPHeaders are added
+	// to its requests and failed ones are retried HTTPMaxRetries times
+	// within HTTPTimeout.
+	HTTPCAFile      string
+	HTTPCertFile    string
+	HTTPKeyFile     string
+	HTTPBearerToken string
+	HTTPHeaders     map[string]string
+	HTTPMaxRetries  int
+	HTTPTimeout     time.Duration
+
+	// PushgatewayAddress is the URL of a Pushgateway that receives the
+	// metrics after every process report and on Stop.
+	PushgatewayAddress string
+
+	// OTLPAddress is the base URL of an OTLP/HTTP receiver, metrics are
+	// sent to /v1/metrics with OTLPProtocol after every process report and
+	// on Stop.
+	OTLPAddress  string
+	OTLPProtocol string
+
+	// ProfileDir receives the CPU, block and heap profiles as gzipped pprof
+	// files, rotated by ProfileMaxSize and ProfileMaxAge.
+	ProfileDir     string
+	ProfileMaxSize int64
+	ProfileMaxAge  time.Duration
+
+	// IngestAddress is the base URL of a Pyroscope compatible ingest API
+	// that receives the CPU, block and heap profiles with IngestLabels.
+	IngestAddress     string
+	IngestLabels      map[string]string
+	IngestConcurrency int
+	IngestMaxRetries  int
+
+	// StatsDAddress is the host:port of a StatsD or, with StatsDDogStatsD,
+	// DogStatsD server that receives process metrics, segment timings and
+	// error counts.
+	StatsDAddress       string
+	StatsDPrefix        string
+	StatsDDogStatsD     bool
+	StatsDTags          []string
+	StatsDMaxPacketSize int
+
+	// SegmentBuckets are the histogram buckets of segment durations in
+	// seconds. SegmentNativeHistogramFactor above 1 adds native histogram
+	// buckets with that growth factor.
+	SegmentBuckets               []float64
+	SegmentNativeHistogramFactor float64
 }
 
 //NewAgent ...
-func NewAgent(histo *prometheus.HistogramVec) *Agent {
+func NewAgent() *Agent {
 	a := &Agent{
-		nextID:  0,
-		runID:   "",
-		buildID: "",
-		runTs:   time.Now().Unix(),
+		started:   0,
+		startLock: &sync.Mutex{},
+		nextID:    0,
+		runID:     "",
+		buildID:   "",
+		runTs:     time.Now().Unix(),
 
 		apiRequest:         nil,
 		config:             nil,
 		configLoader:       nil,
 		messageQueue:       nil,
+		messageSpool:       nil,
 		processReporter:    nil,
 		cpuReporter:        nil,
 		allocationReporter: nil,
 		blockReporter:      nil,
 		segmentReporter:    nil,
 		errorReporter:      nil,
-
-		profilerLock: &sync.Mutex{},
+		stats:              nil,
+		adminHandler:       nil,
+		metricCollector:    nil,
+		pushgatewayPusher:  nil,
+		httpExporter:       nil,
+		otlpExporter:       nil,
+		profileFileSink:    nil,
+		ingestUploader:     nil,
+		statsdExporter:     nil,
+		fileExporter:       nil,
+		httpClient:         nil,
+
+		profilerLock: profilerLock,
 
 		PromethRoute:   DefaultPromethRoute,
 		ProxyAddress:   "",
@@ -85,30 +205,95 @@ func NewAgent(histo *prometheus.HistogramVec) *Agent {
 		HostName:       "",
 		Debug:          false,
 		ProfileAgent:   false,
+		AdminToken:     "",
+		TopFunctions:   DefaultTopFunctions,
+		Logger:         nil,
+		Registerer:     prometheus.DefaultRegisterer,
+
+		DashboardAddress: "",
+		Exporter:         nil,
+
+		SpoolDir:     "",
+		SpoolMaxSize: DefaultSpoolMaxSize,
+
+		QueueMaxMessages: DefaultQueueMaxMessages,
+		QueueMaxSize:     DefaultQueueMaxSize,
+		QueueDropPolicy:  QueueDropOldest,
+		QueueBatchSize:   DefaultQueueBatchSize,
+
+		ExportFile:         "",
+		ExportFileMaxSize:  DefaultExportFileMaxSize,
+		ExportFileMaxFiles: DefaultExportFileMaxFiles,
+
+		HTTPCAFile:      "",
+		HTTPCertFile:    "",
+		HTTPKeyFile:     "",
+		HTTPBearerToken: "",
+		HTTPHeaders:     nil,
+		HTTPMaxRetries:  DefaultHTTPMaxRetries,
+		HTTPTimeout:     DefaultHTTPTimeout,
+
+		PushgatewayAddress: "",
+
+		OTLPAddress:  "",
+		OTLPProtocol: OTLPProtocolProtobuf,
+
+		ProfileDir:     "",
+		ProfileMaxSize: DefaultProfileMaxSize,
+		ProfileMaxAge:  DefaultProfileMaxAge,
+
+		IngestAddress:     "",
+		IngestLabels:      nil,
+		IngestConcurrency: DefaultIngestConcurrency,
+		IngestMaxRetries:  DefaultIngestMaxRetries,
+
+		StatsDAddress:       "",
+		StatsDPrefix:        DefaultStatsDPrefix,
+		StatsDDogStatsD:     false,
+		StatsDTags:          nil,
+		StatsDMaxPacketSize: DefaultStatsDMaxPacketSize,
+
+		SegmentBuckets:               nil,
+		SegmentNativeHistogramFactor: 0,
 	}
 
 	a.buildID = a.calculateProgramSHA1()
 	a.runID = a.uuid()
 
-	a.apiRequest = newAPIRequest(a, histo)
+	a.stats = newAgentStats()
+	a.apiRequest = newAPIRequest(a)
 	a.config = newConfig(a)
 	a.configLoader = newConfigLoader(a)
 	a.messageQueue = newMessageQueue(a)
+	a.messageSpool = newMessageSpool(a)
 	a.processReporter = newProcessReporter(a)
 	a.cpuReporter = newCPUReporter(a)
 	a.allocationReporter = newAllocationReporter(a)
 	a.blockReporter = newBlockReporter(a)
 	a.segmentReporter = newSegmentReporter(a)
 	a.errorReporter = newErrorReporter(a)
+	a.adminHandler = newAdminHandler(a)
+	a.metricCollector = newMetricCollector(a)
+	a.pushgatewayPusher = newPushgatewayPusher(a)
+	a.httpExporter = newHTTPExporter(a)
+	a.otlpExporter = newOTLPExporter(a)
+	a.profileFileSink = newProfileFileSink(a)
+	a.ingestUploader = newIngestUploader(a)
+	a.statsdExporter = newStatsDExporter(a)
+	a.fileExporter = newFileExporter(a)
+	a.httpClient = newHTTPClient(a)
 
 	return a
 }
 
+//Start ...
 func (a *Agent) Start() {
-	if agentStarted {
+	a.startLock.Lock()
+	defer a.startLock.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&a.started, 0, 1) {
 		return
 	}
-	agentStarted = true
 
 	if a.HostName == "" {
 		hostName, err := os.Hostname()
@@ -118,7 +303,11 @@ func (a *Agent) Start() {
 		a.HostName = hostName
 	}
 
+	a.metricCollector.start()
+	a.statsdExporter.start()
+
 	a.configLoader.start()
+	a.messageSpool.start()
 	a.messageQueue.start()
 	a.processReporter.start()
 	a.cpuReporter.start()
@@ -127,11 +316,68 @@ func (a *Agent) Start() {
 	a.segmentReporter.start()
 	a.errorReporter.start()
 
-	a.log("Agent started.")
+	a.info("Agent started.")
 
 	return
 }
 
+//Stop stops all reporters, waits for in-flight profiler runs, reports the
+// data collected so far and flushes the message queue. If ctx is done before
+// the final flush completes, Stop returns ctx.Err() and the flush continues
+// in the background. Start and Stop wait for such a shutdown to complete.
+func (a *Agent) Stop(ctx context.Context) error {
+	a.startLock.Lock()
+	if !atomic.CompareAndSwapInt32(&a.started, 1, 0) {
+		a.startLock.Unlock()
+		return nil
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer a.startLock.Unlock()
+		defer a.recoverAndLog()
+
+		a.configLoader.stop()
+		a.messageQueue.stop()
+		a.processReporter.stop()
+		a.cpuReporter.stop()
+		a.allocationReporter.stop()
+		a.blockReporter.stop()
+		a.segmentReporter.stop()
+		a.errorReporter.stop()
+
+		a.processReporter.report()
+		a.cpuReporter.profilerScheduler.executeReport()
+		a.allocationReporter.profilerScheduler.executeReport()
+		a.blockReporter.profilerScheduler.executeReport()
+		a.segmentReporter.report()
+		a.errorReporter.report()
+
+		a.messageQueue.flush()
+		a.messageSpool.close()
+		a.fileExporter.close()
+		a.pushgatewayPusher.push()
+		a.otlpExporter.export()
+		a.ingestUploader.stop()
+		a.statsdExporter.stop()
+		a.httpClient.stop()
+
+		a.info("Agent stopped.")
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *Agent) isStarted() bool {
+	return atomic.LoadInt32(&a.started) == 1
+}
+
 func (a *Agent) calculateProgramSHA1() string {
 	file, err := os.Open(os.Args[0])
 	if err != nil {
@@ -149,16 +395,71 @@ func (a *Agent) calculateProgramSHA1() string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
+// exporter returns the Exporter of the message queue, nil if there is none.
+func (a *Agent) exporter() Exporter {
+	if a.Exporter != nil {
+		return a.Exporter
+	}
+
+	if a.ExportFile != "" {
+		return a.fileExporter
+	}
+
+	if a.DashboardAddress != "" {
+		return a.httpExporter
+	}
+
+	return nil
+}
+
+// publishMetric queues the metric's measurement for upload and exposes it
+// through the Prometheus collector.
+func (a *Agent) publishMetric(metric *Metric) {
+	if !metric.hasMeasurement() {
+		return
+	}
+
+	a.metricCollector.update(metric)
+	a.otlpExporter.update(metric)
+	a.messageQueue.addMessage(Message{Topic: TopicMetric, Metric: metric.toPayload()})
+}
+
+// publishProfile passes a profile read between start and end by the CPU,
+// block or heap reporter to the profile sinks, before it is aggregated.
+func (a *Agent) publishProfile(profiler string, start time.Time, end time.Time, p *profile.Profile) {
+	a.profileFileSink.write(profiler, start, p)
+	a.ingestUploader.upload(profiler, start, end, p)
+}
+
+// publishTopFunctions exposes the hottest functions of a profile. It must be
+// called before the profile is filtered.
+func (a *Agent) publishTopFunctions(profiler string, unit string, profile *BreakdownNode) {
+	if a.TopFunctions <= 0 {
+		return
+	}
+
+	self, cumulative := profile.topFunctions(a.TopFunctions)
+	a.metricCollector.updateFunctions(profiler, unit, self, cumulative)
+}
+
+//RecordSegment ...
 func (a *Agent) RecordSegment(name string, duration float64) {
-	if !agentStarted {
+	a.RecordSegmentPath([]string{name}, duration)
+}
+
+//RecordSegmentPath records a nested segment. The first path element is the
+// top-level segment, the last one is the measured segment.
+func (a *Agent) RecordSegmentPath(path []string, duration float64) {
+	if !a.isStarted() {
 		return
 	}
 
-	a.segmentReporter.recordSegment(name, duration)
+	a.segmentReporter.recordSegmentPath(path, duration)
 }
 
+//RecordError ...
 func (a *Agent) RecordError(group string, msg interface{}, skipFrames int) {
-	if !agentStarted {
+	if !a.isStarted() {
 		return
 	}
 
@@ -173,25 +474,75 @@ func (a *Agent) RecordError(group string, msg interface{}, skipFrames int) {
 	a.errorReporter.recordError(group, err, skipFrames+1)
 }
 
-func (a *Agent) log(format string, values ...interface{}) {
-	if a.Debug {
-		fmt.Printf("["+time.Now().Format(time.StampMilli)+"]"+
-			" StackImpact "+AgentVersion+": "+
-			format+"\n", values...)
+//PauseProfiling stops the CPU, block and heap profilers until
+// ResumeProfiling is called.
+func (a *Agent) PauseProfiling() {
+	a.config.setProfilingPaused(true)
+	a.info("Profiling paused.")
+}
+
+//ResumeProfiling ...
+func (a *Agent) ResumeProfiling() {
+	a.config.setProfilingPaused(false)
+	a.info("Profiling resumed.")
+}
+
+//IsProfilingPaused ...
+func (a *Agent) IsProfilingPaused() bool {
+	return a.config.isProfilingPaused()
+}
+
+//SetProfilerEnabled switches one of Profilers on or off at runtime.
+func (a *Agent) SetProfilerEnabled(profiler string, enabled bool) error {
+	if err := a.config.setProfilerEnabled(profiler, enabled); err != nil {
+		return err
 	}
+
+	a.info("Profiler %v enabled: %v.", profiler, enabled)
+	return nil
 }
 
-func (a *Agent) error(err error) {
+//IsProfilerEnabled ...
+func (a *Agent) IsProfilerEnabled(profiler string) bool {
+	return a.config.isProfilerEnabled(profiler)
+}
+
+//LogError logs err through the configured logger.
+func (a *Agent) LogError(err error) {
+	a.error(err)
+}
+
+func (a *Agent) logger() Logger {
+	if a.Logger != nil {
+		return a.Logger
+	}
+
 	if a.Debug {
-		fmt.Println("[" + time.Now().Format(time.StampMilli) + "]" +
-			" StackImpact " + AgentVersion + ": Error")
-		fmt.Println(err)
+		return debugLogger
 	}
+
+	return nopLogger{}
+}
+
+func (a *Agent) log(format string, values ...interface{}) {
+	a.logger().Debug(fmt.Sprintf(format, values...), "app_name", a.AppName)
+}
+
+func (a *Agent) info(format string, values ...interface{}) {
+	a.logger().Info(fmt.Sprintf(format, values...), "app_name", a.AppName)
+}
+
+func (a *Agent) warn(format string, values ...interface{}) {
+	a.logger().Warn(fmt.Sprintf(format, values...), "app_name", a.AppName)
+}
+
+func (a *Agent) error(err error) {
+	a.logger().Error("Agent error", "app_name", a.AppName, "error", err)
 }
 
 func (a *Agent) recoverAndLog() {
 	if err := recover(); err != nil {
-		a.log("Recovered from panic in agent: %v", err)
+		a.logger().Error("Recovered from panic in agent", "app_name", a.AppName, "panic", err)
 	}
 }
 
@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+//AgentStats measures the agent's own overhead. The values are reported by
+// ProcessReporter in the agent metric category.
+type AgentStats struct {
+	statsLock         *sync.Mutex
+	runTimes          map[string]*RunTime
+	exportFailures    int64
+	queueDropped      int64
+	queueRetried      int64
+	lastReports       map[string]int64
+	lastExportError   string
+	lastExportErrorTs int64
+}
+
+//RunTime is the accumulated cost of profiler record or report runs or of
+// profile parsing.
+type RunTime struct {
+	wallTime int64
+	cpuTime  int64
+	hasCPU   bool
+}
+
+func newAgentStats() *AgentStats {
+	as := &AgentStats{
+		statsLock:         &sync.Mutex{},
+		runTimes:          make(map[string]*RunTime),
+		exportFailures:    0,
+		queueDropped:      0,
+		queueRetried:      0,
+		lastReports:       make(map[string]int64),
+		lastExportError:   "",
+		lastExportErrorTs: 0,
+	}
+
+	return as
+}
+
+// measureRun runs f and accumulates its wall time only. A record run mostly
+// waits for the end of the profiling window, so its active work is measured
+// separately by parseProfile.
+func (as *AgentStats) measureRun(name string, f func()) {
+	start := time.Now()
+
+	f()
+
+	as.addRunTime(name, time.Since(start).Nanoseconds(), 0, false)
+}
+
+// measureActive runs f, which must not wait, and accumulates its wall time
+// and, where supported, the CPU time of the OS thread it ran on. The goroutine
+// is locked to its thread while f runs, so the thread CPU time is not shared
+// with other goroutines.
+func (as *AgentStats) measureActive(name string, f func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	start := time.Now()
+	cpuStart, cpuErr := readThreadCPUTime()
+
+	f()
+
+	wallTime := time.Since(start).Nanoseconds()
+	var cpuTime int64
+	if cpuErr == nil {
+		var cpuEnd int64
+		if cpuEnd, cpuErr = readThreadCPUTime(); cpuErr == nil {
+			cpuTime = cpuEnd - cpuStart
+		}
+	}
+
+	as.addRunTime(name, wallTime, cpuTime, cpuErr == nil)
+}
+
+func (as *AgentStats) addRunTime(name string, wallTime int64, cpuTime int64, hasCPU bool) {
+	as.statsLock.Lock()
+	defer as.statsLock.Unlock()
+
+	rt, exists := as.runTimes[name]
+	if !exists {
+		rt = &RunTime{}
+		as.runTimes[name] = rt
+	}
+	rt.wallTime += wallTime
+	if hasCPU {
+		rt.cpuTime += cpuTime
+		rt.hasCPU = true
+	}
+}
+
+func (as *AgentStats) readRunTimes() map[string]RunTime {
+	as.statsLock.Lock()
+	defer as.statsLock.Unlock()
+
+	read := make(map[string]RunTime)
+	for name, rt := range as.runTimes {
+		read[name] = *rt
+	}
+
+	return read
+}
+
+func (as *AgentStats) recordExportFailure(err error) {
+	atomic.AddInt64(&as.exportFailures, 1)
+
+	as.statsLock.Lock()
+	defer as.statsLock.Unlock()
+
+	as.lastExportError = err.Error()
+	as.lastExportErrorTs = time.Now().Unix()
+}
+
+func (as *AgentStats) readLastExportError() (string, int64) {
+	as.statsLock.Lock()
+	defer as.statsLock.Unlock()
+
+	return as.lastExportError, as.lastExportErrorTs
+}
+
+// recordReport saves the time of the last report of one of Profilers.
+func (as *AgentStats) recordReport(profiler string) {
+	as.statsLock.Lock()
+	defer as.statsLock.Unlock()
+
+	as.lastReports[profiler] = time.Now().Unix()
+}
+
+func (as *AgentStats) readLastReport(profiler string) int64 {
+	as.statsLock.Lock()
+	defer as.statsLock.Unlock()
+
+	return as.lastReports[profiler]
+}
+
+func (as *AgentStats) readExportFailures() int64 {
+	return atomic.LoadInt64(&as.exportFailures)
+}
+
+// recordQueueDrops counts messages dropped from the full or expired message
+// queue and returns the total.
+func (as *AgentStats) recordQueueDrops(n int) int64 {
+	return atomic.AddInt64(&as.queueDropped, int64(n))
+}
+
+func (as *AgentStats) readQueueDropped() int64 {
+	return atomic.LoadInt64(&as.queueDropped)
+}
+
+// recordQueueRetries counts messages kept for another export after a failed
+// one.
+func (as *AgentStats) recordQueueRetries(n int) {
+	atomic.AddInt64(&as.queueRetried, int64(n))
+}
+
+func (as *AgentStats) readQueueRetried() int64 {
+	return atomic.LoadInt64(&as.queueRetried)
+}
+
+// readParseAllocated returns the bytes allocated by parseProfile since the
+// process started, estimated from the stacks of the heap profile, so
+// allocations of the application are not included. Like the heap profile,
+// the value is as of the last garbage collection and is shared by all agents
+// of the process.
+func readParseAllocated() int64 {
+	if runtime.MemProfileRate <= 0 {
+		return 0
+	}
+
+	n, _ := runtime.MemProfile(nil, true)
+	var records []runtime.MemProfileRecord
+	for {
+		records = make([]runtime.MemProfileRecord, n+50)
+		var ok bool
+		if n, ok = runtime.MemProfile(records, true); ok {
+			records = records[:n]
+			break
+		}
+	}
+
+	rate := float64(runtime.MemProfileRate)
+	var allocated float64
+	for _, r := range records {
+		if r.AllocObjects == 0 || !inParseProfile(r.Stack()) {
+			continue
+		}
+
+		// scaled like the samples of pprof heap profiles
+		size := float64(r.AllocBytes)
+		if rate > 1 {
+			avgSize := size / float64(r.AllocObjects)
+			size = size / (1 - math.Exp(-avgSize/rate))
+		}
+		allocated += size
+	}
+
+	return int64(allocated)
+}
+
+func inParseProfile(stack []uintptr) bool {
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		if strings.Contains(frame.Function, ".(*Agent).parseProfile") {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// parseProfile parses and symbolizes a profile. Its wall and CPU time are
+// accumulated as NameProfileParsing run.
+func (a *Agent) parseProfile(r io.Reader) (p *profile.Profile, err error) {
+	a.stats.measureActive(NameProfileParsing, func() {
+		if p, err = profile.Parse(r); err != nil {
+			return
+		}
+
+		err = symbolizeProfile(p)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (pr *ProcessReporter) reportAgentStats() {
+	stats := pr.agent.stats
+
+	runTimes := stats.readRunTimes()
+	names := make([]string, 0, len(runTimes))
+	for name := range runTimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rt := runTimes[name]
+		pr.reportMetric(TypeCounter, CategoryAgent, name+" wall time", UnitNanosecond, float64(rt.wallTime))
+		if rt.hasCPU {
+			pr.reportMetric(TypeCounter, CategoryAgent, name+" CPU time", UnitNanosecond, float64(rt.cpuTime))
+		}
+	}
+
+	pr.reportMetric(TypeCounter, CategoryAgent, NameProfileParseAllocations, UnitByte, float64(readParseAllocated()))
+	pr.reportMetric(TypeState, CategoryAgent, NameMessageQueueSize, UnitNone, float64(pr.agent.messageQueue.size()))
+	pr.reportMetric(TypeCounter, CategoryAgent, NameExportFailures, UnitNone, float64(stats.readExportFailures()))
+	pr.reportMetric(TypeCounter, CategoryAgent, NameQueueDroppedMessages, UnitNone, float64(stats.readQueueDropped()))
+	pr.reportMetric(TypeCounter, CategoryAgent, NameQueueRetriedMessages, UnitNone, float64(stats.readQueueRetried()))
+	if pr.agent.messageSpool.enabled() {
+		pr.reportMetric(TypeCounter, CategoryAgent, NameSpoolDroppedMessages, UnitNone, float64(pr.agent.messageSpool.readDropped()))
+	}
+}
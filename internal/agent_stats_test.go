@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMeasureRun(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	agent.stats.measureRun("Test profiler record", func() {
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	rt := agent.stats.readRunTimes()["Test profiler record"]
+	if rt.wallTime < int64(10*time.Millisecond) {
+		t.Errorf("Wall time is too low: %v", rt.wallTime)
+	}
+
+	if rt.hasCPU {
+		t.Error("CPU time should not be measured for a waiting run")
+	}
+
+	agent.stats.measureActive("Test profiler report", func() {
+		for i := 0; i < 1e6; i++ {
+			_ = i * i
+		}
+	})
+
+	rt = agent.stats.readRunTimes()["Test profiler report"]
+	if runtime.GOOS == "linux" && !rt.hasCPU {
+		t.Error("CPU time should be measured on linux")
+	}
+}
+
+var testAllocation []byte
+
+func TestParseAllocated(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	memProfileRate := runtime.MemProfileRate
+	runtime.MemProfileRate = 1
+	defer func() {
+		runtime.MemProfileRate = memProfileRate
+	}()
+
+	if _, err := agent.allocationReporter.readHeapProfile(); err != nil {
+		t.Error(err)
+		return
+	}
+	runtime.GC()
+
+	allocated := readParseAllocated()
+	if allocated <= 0 {
+		t.Errorf("Allocated bytes should be > 0, but are %v", allocated)
+	}
+
+	if _, exists := agent.stats.readRunTimes()[NameProfileParsing]; !exists {
+		t.Error("Run time of profile parsing should be measured")
+	}
+
+	// allocations outside of parseProfile are not counted
+	testAllocation = make([]byte, 10e6)
+	runtime.GC()
+
+	if readParseAllocated()-allocated >= int64(len(testAllocation)) {
+		t.Errorf("Allocated bytes should not include the application's allocations: %v", readParseAllocated()-allocated)
+	}
+}
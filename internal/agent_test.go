@@ -1,7 +1,13 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestStart(t *testing.T) {
@@ -34,3 +40,153 @@ func TestCalculateProgramSHA1(t *testing.T) {
 		t.Error("failed calculating program SHA1")
 	}
 }
+
+func TestStop(t *testing.T) {
+	agent := NewAgent()
+	agent.AppName = "GoTestApp"
+	agent.Debug = true
+
+	before := runtime.NumGoroutine()
+	agent.Start()
+	agent.RecordSegment("seg1", 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := agent.Stop(ctx); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Goroutines leaked: %v before Start, %v after Stop", before, after)
+	}
+
+	if len(agent.segmentReporter.segmentNodes) != 0 {
+		t.Error("Segments were not reported on Stop")
+	}
+
+	if len(agent.messageQueue.queue) != 0 {
+		t.Errorf("Message queue was not flushed on Stop, has %v messages", len(agent.messageQueue.queue))
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	exporter := &testExporter{wait: make(chan bool)}
+	agent := NewAgent()
+	agent.AppName = "GoTestApp"
+	agent.Exporter = exporter
+
+	agent.Start()
+	agent.messageQueue.addMessage(testMessage(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := agent.Stop(ctx); err != context.Canceled {
+		t.Errorf("Stop should return ctx.Err(), got %v", err)
+	}
+
+	// the shutdown is blocked in the final flush, Start waits for it
+	started := make(chan bool)
+	go func() {
+		agent.Start()
+		close(started)
+	}()
+
+	select {
+	case <-started:
+		t.Error("Start should wait for the shutdown to complete")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(exporter.wait)
+	<-started
+
+	if !agent.isStarted() || agent.messageQueue.stopChan == nil {
+		t.Error("Agent was not restarted after the shutdown")
+	}
+
+	if err := agent.Stop(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultipleAgents(t *testing.T) {
+	agent1 := NewAgent()
+	agent1.AppName = "App1"
+	agent1.Start()
+
+	agent2 := NewAgent()
+	agent2.AppName = "App2"
+	agent2.Start()
+
+	if !agent1.isStarted() || !agent2.isStarted() {
+		t.Error("Both agents should be started")
+	}
+
+	agent1.RecordSegment("seg1", 10)
+	agent2.RecordSegment("seg2", 20)
+
+	if _, exists := agent1.segmentReporter.segmentNodes["seg2"]; exists {
+		t.Error("seg2 should not be recorded by agent1")
+	}
+
+	if _, exists := agent2.segmentReporter.segmentNodes["seg1"]; exists {
+		t.Error("seg1 should not be recorded by agent2")
+	}
+
+	if agent1.profilerLock != agent2.profilerLock {
+		t.Error("Agents should share the process-wide profiler lock")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	agent1.Stop(ctx)
+	if agent1.isStarted() || !agent2.isStarted() {
+		t.Error("Stopping agent1 should not stop agent2")
+	}
+	agent2.Stop(ctx)
+}
+
+type testLogger struct {
+	lock     *sync.Mutex
+	messages []string
+}
+
+func (tl *testLogger) add(level string, msg string) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+
+	tl.messages = append(tl.messages, level+": "+msg)
+}
+
+func (tl *testLogger) Debug(msg string, keysAndValues ...interface{}) { tl.add("DEBUG", msg) }
+func (tl *testLogger) Info(msg string, keysAndValues ...interface{})  { tl.add("INFO", msg) }
+func (tl *testLogger) Warn(msg string, keysAndValues ...interface{})  { tl.add("WARN", msg) }
+func (tl *testLogger) Error(msg string, keysAndValues ...interface{}) { tl.add("ERROR", msg) }
+
+func TestLogger(t *testing.T) {
+	logger := &testLogger{lock: &sync.Mutex{}}
+
+	agent := NewAgent()
+	agent.Logger = logger
+
+	agent.log("debug %v", 1)
+	agent.error(errors.New("error1"))
+	agent.messageQueue.addMessage(testMessage(1))
+
+	if len(logger.messages) < 3 {
+		t.Errorf("Messages were not routed to logger: %v", logger.messages)
+		return
+	}
+
+	if logger.messages[0] != "DEBUG: debug 1" || logger.messages[1] != "ERROR: Agent error" {
+		t.Errorf("Unexpected messages: %v", logger.messages)
+	}
+
+	var _ Logger = slog.Default()
+	var _ Logger = nopLogger{}
+}
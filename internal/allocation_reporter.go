@@ -5,10 +5,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"math"
 	"runtime"
 	"runtime/pprof"
+	"time"
 
 	"github.com/darshanman/profile-agent/internal/pprof/profile"
 )
@@ -49,7 +49,7 @@ func newAllocationReporter(agent *Agent) *AllocationReporter {
 		profilerScheduler: nil,
 	}
 
-	ar.profilerScheduler = newProfilerScheduler(agent, 0, 0, 120000, nil,
+	ar.profilerScheduler = newProfilerScheduler(agent, "Heap profiler", 0, 0, 120000, nil,
 		func() {
 			ar.report()
 		},
@@ -62,33 +62,43 @@ func (ar *AllocationReporter) start() {
 	ar.profilerScheduler.start()
 }
 
+func (ar *AllocationReporter) stop() {
+	ar.profilerScheduler.stop()
+}
+
 func (ar *AllocationReporter) report() {
-	if ar.agent.config.profilingDisabled {
+	if !ar.agent.config.isProfilingActive(ProfilerHeap) {
+		ar.agent.metricCollector.updateFunctions(ProfilerHeap, UnitByte, nil, nil)
 		return
 	}
 
-	log.Println("Reading heap profile...")
+	ar.agent.log("Reading heap profile.")
+	start := time.Now()
 	p, e := ar.readHeapProfile()
 	if e != nil {
-		log.Println("ERR: ", e)
+		ar.agent.error(e)
 		return
 	}
 	if p == nil {
 		return
 	}
-	log.Println("Done.")
+	ar.agent.log("Heap profile read.")
+
+	ar.agent.publishProfile(ProfilerHeap, start, time.Now(), p)
 
 	// allocated size
 	if callGraph, err := ar.createAllocationCallGraph(p); err != nil {
 		ar.agent.error(err)
 	} else {
+		ar.agent.publishTopFunctions(ProfilerHeap, UnitByte, callGraph)
+
 		// filter calls with lower than 10KB
 		callGraph.filter(2, 10000, math.Inf(0))
 
 		metric := newMetric(ar.agent, TypeProfile, CategoryMemoryProfile, NameHeapAllocation, UnitByte)
 		metric.createMeasurement(TriggerTimer, callGraph.measurement, 0, callGraph)
-		ar.agent.messageQueue.pushMessage("memory", metric.toStringArray())
-		// ar.agent.messageQueue.addMessage("metric", metric.toMap())
+		ar.agent.publishMetric(metric)
+		ar.agent.stats.recordReport(ProfilerHeap)
 	}
 }
 
@@ -161,12 +171,9 @@ func (ar *AllocationReporter) readHeapProfile() (*profile.Profile, error) {
 	r := bufio.NewReader(&buf)
 	var p *profile.Profile
 	var perr error
-	if p, perr = profile.Parse(r); perr != nil {
+	if p, perr = ar.agent.parseProfile(r); perr != nil {
 		return nil, perr
 	}
-	if serr := symbolizeProfile(p); serr != nil {
-		return nil, serr
-	}
 
 	if verr := p.CheckValid(); verr != nil {
 		return nil, verr
@@ -1,8 +1,8 @@
 package internal
 
 import (
-	"fmt"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -16,7 +16,7 @@ func TestCreateAllocationCallGraph(t *testing.T) {
 
 	objs = make([]string, 0)
 	for i := 0; i < 100000; i++ {
-		objs = append(objs, string(i))
+		objs = append(objs, strconv.Itoa(i))
 	}
 
 	runtime.GC()
@@ -39,7 +39,7 @@ func TestCreateAllocationCallGraph(t *testing.T) {
 		t.Error("Number of samples should be > 0")
 	}
 
-	if !strings.Contains(fmt.Sprintf("%v", callGraph.toMap()), "TestCreateAllocationCallGraph") {
+	if !strings.Contains(wireJSON(t, callGraph.toPayload()), "TestCreateAllocationCallGraph") {
 		t.Error("The test function is not found in the profile")
 	}
 
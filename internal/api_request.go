@@ -3,77 +3,42 @@ package internal
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"runtime"
 	"strconv"
 	"time"
-
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 //APIRequest ...
 type APIRequest struct {
 	agent *Agent
-	histo *prometheus.HistogramVec //http.Handler
 }
 
-func newAPIRequest(a *Agent, histo *prometheus.HistogramVec) *APIRequest {
+func newAPIRequest(a *Agent) *APIRequest {
 	ar := &APIRequest{
 		agent: a,
-		histo: histo,
 	}
 
 	return ar
 }
 
-func (ar *APIRequest) push(vecType string, payload []string) (map[string]interface{}, error) {
-	// switch vecType {
-	// case "histogram":
-	if len(payload) < 1 {
-		log.Println("returning... len(payload) is, ", len(payload))
-		return nil, nil
-	}
-	now := time.Now()
-	log.Println("pushing to hist")
-	log.Println("len(payload): ", len(payload))
-	log.Println("payload: ", payload)
-	// values := make([]string, len(payload))
-	// i := 0
-	// var value string
-	// for _, pl := range payload {
-	// 	switch p := pl.(type) {
-	// 	case map[string]interface{}:
-	// 		value = fmt.Sprint(p["content"])
-	// 	default:
-	// 		value = fmt.Sprint(p)
-	// 		log.Println(value)
-	// 		values[i] = value
-	// 	}
-	//
-	// 	i++
-	// }
-	time.Sleep(1000 * time.Millisecond)
-	if obs, err := ar.histo.GetMetricWithLabelValues(payload...); err != nil {
-		log.Println("ERR: ", err)
-
-	} else {
-		obs.Observe(time.Since(now).Seconds())
-	}
-
-	// ar.histo.WithLabelValues(payload...).Observe(time.Since(now).Seconds())
-	// }
-	return nil, nil
+func (ar *APIRequest) post(endpoint string, payload map[string]interface{}) (map[string]interface{}, error) {
+	return ar.postContext(context.Background(), endpoint, payload)
 }
 
-func (ar *APIRequest) post(endpoint string, payload map[string]interface{}) (map[string]interface{}, error) {
-	log.Println("returning from APIRrequest.Post")
-	return nil, nil
+// postContext sends payload in the agent metadata envelope as gzipped JSON
+// to DashboardAddress + /agent/v1/ + endpoint and returns the JSON response.
+func (ar *APIRequest) postContext(ctx context.Context, endpoint string, payload map[string]interface{}) (map[string]interface{}, error) {
+	if ar.agent.DashboardAddress == "" {
+		return nil, errors.New("Dashboard address is not set")
+	}
+
 	reqBody := map[string]interface{}{
 		"runtime_type":    "go",
 		"runtime_version": runtime.Version(),
@@ -90,15 +55,18 @@ func (ar *APIRequest) post(endpoint string, payload map[string]interface{}) (map
 		"payload":         payload,
 	}
 
-	reqbodyJSON, _ := json.Marshal(reqBody)
+	reqbodyJSON, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
 
 	var buf bytes.Buffer
 	w := gzip.NewWriter(&buf)
 	w.Write(reqbodyJSON)
 	w.Close()
 
-	u := ar.agent.PromethRoute + "/agent/v1/" + endpoint
-	req, err := http.NewRequest("POST", u, &buf)
+	u := ar.agent.DashboardAddress + "/agent/v1/" + endpoint
+	req, err := http.NewRequestWithContext(ctx, "POST", u, &buf)
 	if err != nil {
 		return nil, err
 	}
@@ -109,21 +77,9 @@ func (ar *APIRequest) post(endpoint string, payload map[string]interface{}) (map
 
 	ar.agent.log("Posting API request to %v", u)
 
-	var httpClient *http.Client
-	if ar.agent.ProxyAddress != "" {
-		var proxyURL *url.URL
-		if proxyURL, err = url.Parse(ar.agent.ProxyAddress); err != nil {
-			return nil, err
-		}
-
-		httpClient = &http.Client{
-			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
-			Timeout:   time.Second * 20,
-		}
-	} else {
-		httpClient = &http.Client{
-			Timeout: time.Second * 20,
-		}
+	httpClient, err := ar.agent.httpClient.get()
+	if err != nil {
+		return nil, err
 	}
 	res, err := httpClient.Do(req)
 	if err != nil {
@@ -146,5 +102,4 @@ func (ar *APIRequest) post(endpoint string, payload map[string]interface{}) (map
 	}
 
 	return resBody, nil
-
 }
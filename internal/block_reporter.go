@@ -3,6 +3,7 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -39,7 +40,7 @@ func newBlockReporter(agent *Agent) *BlockReporter {
 		profileDuration:   0,
 	}
 
-	br.profilerScheduler = newProfilerScheduler(agent, 10000, 2000, 120000,
+	br.profilerScheduler = newProfilerScheduler(agent, "Block profiler", 10000, 2000, 120000,
 		func(duration int64) {
 			br.record(duration)
 		},
@@ -56,6 +57,10 @@ func (br *BlockReporter) start() {
 	br.profilerScheduler.start()
 }
 
+func (br *BlockReporter) stop() {
+	br.profilerScheduler.stop()
+}
+
 func (br *BlockReporter) reset() {
 	br.blockProfile = newBreakdownNode("root")
 	br.httpProfile = newBreakdownNode("root")
@@ -63,11 +68,12 @@ func (br *BlockReporter) reset() {
 }
 
 func (br *BlockReporter) record(duration int64) {
-	if br.agent.config.isProfilingDisabled() {
+	if !br.agent.config.isProfilingActive(ProfilerBlock) {
 		return
 	}
 
 	br.agent.log("Starting block profiler.")
+	start := time.Now()
 	p, e := br.readBlockProfile(duration)
 	if e != nil {
 		br.agent.error(e)
@@ -78,6 +84,8 @@ func (br *BlockReporter) record(duration int64) {
 	}
 	br.agent.log("Block profiler stopped.")
 
+	br.agent.publishProfile(ProfilerBlock, start, time.Now(), p)
+
 	err := br.updateBlockProfile(p, duration)
 	if err != nil {
 		br.agent.error(err)
@@ -88,14 +96,25 @@ func (br *BlockReporter) record(duration int64) {
 }
 
 func (br *BlockReporter) report() {
+	if !br.agent.config.isProfilingActive(ProfilerBlock) {
+		br.agent.metricCollector.updateFunctions(ProfilerBlock, UnitMillisecond, nil, nil)
+		br.reset()
+		return
+	}
+
+	if br.profileDuration == 0 {
+		return
+	}
+
 	durationSec := float64(br.profileDuration) / 1000
 
 	br.blockProfile.normalize(durationSec)
+	br.agent.publishTopFunctions(ProfilerBlock, UnitMillisecond, br.blockProfile)
 	br.blockProfile.filter(2, 1, math.Inf(0))
 
 	metric := newMetric(br.agent, TypeProfile, CategoryBlockProfile, NameBlockingCallTimes, UnitMillisecond)
 	metric.createMeasurement(TriggerTimer, br.blockProfile.measurement, 1, br.blockProfile)
-	br.agent.messageQueue.addMessage("metric", metric.toMap())
+	br.agent.publishMetric(metric)
 
 	if br.blockProfile.measurement > 0 && br.httpProfile.numSamples > 0 {
 		br.httpProfile.normalize(durationSec)
@@ -104,8 +123,9 @@ func (br *BlockReporter) report() {
 
 		metric := newMetric(br.agent, TypeProfile, CategoryHTTPTrace, NameHTTPTransactionBreakdown, UnitPercent)
 		metric.createMeasurement(TriggerTimer, br.httpProfile.measurement, 0, br.httpProfile)
-		br.agent.messageQueue.addMessage("metric", metric.toMap())
+		br.agent.publishMetric(metric)
 	}
+	br.agent.stats.recordReport(ProfilerBlock)
 
 	br.reset()
 }
@@ -212,6 +232,13 @@ func (br *BlockReporter) getValueChange(key string, delay float64, contentions i
 }
 
 func (br *BlockReporter) readBlockProfile(duration int64) (*profile.Profile, error) {
+	return br.readBlockProfileContext(context.Background(), duration)
+}
+
+// readBlockProfileContext enables block profiling for duration milliseconds
+// and returns the block profile. If ctx is done earlier, profiling is
+// disabled and ctx.Err() is returned.
+func (br *BlockReporter) readBlockProfileContext(ctx context.Context, duration int64) (*profile.Profile, error) {
 	prof := pprof.Lookup("block")
 	if prof == nil {
 		return nil, errors.New("No block profile found")
@@ -219,18 +246,15 @@ func (br *BlockReporter) readBlockProfile(duration int64) (*profile.Profile, err
 
 	runtime.SetBlockProfileRate(1e6)
 
-	done := make(chan bool)
 	timer := time.NewTimer(time.Duration(duration) * time.Millisecond)
-	go func() {
-		defer br.agent.recoverAndLog()
-
-		<-timer.C
-
+	select {
+	case <-timer.C:
 		runtime.SetBlockProfileRate(0)
-
-		done <- true
-	}()
-	<-done
+	case <-ctx.Done():
+		timer.Stop()
+		runtime.SetBlockProfileRate(0)
+		return nil, ctx.Err()
+	}
 
 	var buf bytes.Buffer
 	w := bufio.NewWriter(&buf)
@@ -244,11 +268,7 @@ func (br *BlockReporter) readBlockProfile(duration int64) (*profile.Profile, err
 	r := bufio.NewReader(&buf)
 	var p *profile.Profile
 	var perr error
-	if p, perr = profile.Parse(r); perr == nil {
-		if serr := symbolizeProfile(p); serr != nil {
-			return nil, serr
-		}
-
+	if p, perr = br.agent.parseProfile(r); perr == nil {
 		if verr := p.CheckValid(); verr != nil {
 			return nil, verr
 		}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
-	"sync"
 	"testing"
 	"time"
 )
@@ -54,7 +53,7 @@ func TestCreateBlockCallGraph(t *testing.T) {
 		t.Error("Number of samples should be > 0")
 	}
 
-	if !strings.Contains(fmt.Sprintf("%v", blockCallGraph.toMap()), "TestCreateBlockCallGraph") {
+	if !strings.Contains(wireJSON(t, blockCallGraph.toPayload()), "TestCreateBlockCallGraph") {
 		t.Error("The test function is not found in the profile")
 	}
 
@@ -73,15 +72,16 @@ func TestCreateHTTPCallGraph(t *testing.T) {
 		})
 
 		http.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
-			lock := &sync.Mutex{}
-			lock.Lock()
+			// a channel receive, unlike an inlined Mutex.Lock, keeps the
+			// handler as the innermost function of the blocked location
+			unblock := make(chan bool)
 
 			go func() {
 				time.Sleep(100 * time.Millisecond)
-				lock.Unlock()
+				close(unblock)
 			}()
 
-			lock.Lock()
+			<-unblock
 
 			fmt.Fprintf(w, "OK")
 		})
@@ -94,6 +94,11 @@ func TestCreateHTTPCallGraph(t *testing.T) {
 
 	waitForServer("http://localhost:6001/ready")
 
+	// the block profile is cumulative, only blocking from here on counts
+	agent.blockReporter.reset()
+	p, _ := agent.blockReporter.readBlockProfile(0)
+	agent.blockReporter.updateBlockProfile(p, 0)
+
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 
@@ -106,7 +111,7 @@ func TestCreateHTTPCallGraph(t *testing.T) {
 	}()
 
 	agent.blockReporter.reset()
-	p, _ := agent.blockReporter.readBlockProfile(500)
+	p, _ = agent.blockReporter.readBlockProfile(500)
 	err := agent.blockReporter.updateBlockProfile(p, 500)
 	if err != nil {
 		t.Error(err)
@@ -132,7 +137,7 @@ func TestCreateHTTPCallGraph(t *testing.T) {
 		t.Error("Number of samples should be > 0")
 	}
 
-	if !strings.Contains(fmt.Sprintf("%v", httpCallGraph.toMap()), "TestCreateHTTPCallGraph") {
+	if !strings.Contains(wireJSON(t, httpCallGraph.toPayload()), "TestCreateHTTPCallGraph") {
 		t.Error("The test function is not found in the profile")
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"math"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -86,8 +87,13 @@ func (bn *BreakdownNode) removeChild(child *BreakdownNode) {
 func (bn *BreakdownNode) findOrAddChild(name string) *BreakdownNode {
 	child := bn.findChild(name)
 	if child == nil {
-		child = newBreakdownNode(name)
-		bn.addChild(child)
+		bn.updateLock.Lock()
+		// If child was not created by other findOrAddChild call between locks, create it.
+		if child = bn.children[name]; child == nil {
+			child = newBreakdownNode(name)
+			bn.children[name] = child
+		}
+		bn.updateLock.Unlock()
 	}
 
 	return child
@@ -212,23 +218,80 @@ func (bn *BreakdownNode) clone() *BreakdownNode {
 	return cln
 }
 
-func (bn *BreakdownNode) toMap() map[string]interface{} {
-	childrenMap := make([]interface{}, len(bn.children))
-	i := 0
+//FunctionValue ...
+type FunctionValue struct {
+	function string
+	value    float64
+}
+
+// topFunctions returns up to n functions with the highest self and
+// cumulative values. Frames of a function from different call sites and
+// lines are merged, recursive frames are counted once in the cumulative
+// value. It must be called before filter, which drops the small children
+// that make up self values.
+func (bn *BreakdownNode) topFunctions(n int) ([]FunctionValue, []FunctionValue) {
+	self := make(map[string]float64)
+	cumulative := make(map[string]float64)
+	onPath := make(map[string]int)
+
+	for _, child := range bn.children {
+		child.collectFunctions(self, cumulative, onPath)
+	}
+
+	return topValues(self, n), topValues(cumulative, n)
+}
+
+func (bn *BreakdownNode) collectFunctions(self map[string]float64, cumulative map[string]float64, onPath map[string]int) {
+	function := frameFunction(bn.name)
+
+	childrenMeasurement := 0.0
+	for _, child := range bn.children {
+		childrenMeasurement += child.measurement
+	}
+	if selfMeasurement := bn.measurement - childrenMeasurement; selfMeasurement > 0 {
+		self[function] += selfMeasurement
+	}
+
+	if onPath[function] == 0 {
+		cumulative[function] += bn.measurement
+	}
+
+	onPath[function]++
 	for _, child := range bn.children {
-		childrenMap[i] = child
-		i++
-		// childrenMap = append(childrenMap, child.toMap())
+		child.collectFunctions(self, cumulative, onPath)
+	}
+	onPath[function]--
+}
+
+// frameFunction strips the " (file:line)" suffix of a frame name.
+func frameFunction(frameName string) string {
+	if i := strings.LastIndex(frameName, " ("); i > 0 {
+		return frameName[:i]
 	}
 
-	nodeMap := map[string]interface{}{
-		"name":        bn.name,
-		"measurement": bn.measurement,
-		"num_samples": bn.numSamples,
-		"children":    childrenMap,
+	return frameName
+}
+
+func topValues(values map[string]float64, n int) []FunctionValue {
+	top := make([]FunctionValue, 0, len(values))
+	for function, value := range values {
+		if value > 0 {
+			top = append(top, FunctionValue{function: function, value: value})
+		}
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].value != top[j].value {
+			return top[i].value > top[j].value
+		}
+		return top[i].function < top[j].function
+	})
+
+	if len(top) > n {
+		top = top[:n]
 	}
 
-	return nodeMap
+	return top
 }
 
 func (bn *BreakdownNode) printLevel(level int) string {
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+//CaptureCPUProfile takes a CPU profile of the given duration on demand. It
+// waits for scheduled profiler runs to finish, so it never overlaps with
+// another pprof.StartCPUProfile call of the agents.
+func (a *Agent) CaptureCPUProfile(ctx context.Context, duration time.Duration) (*profile.Profile, error) {
+	if duration <= 0 {
+		return nil, errors.New("Capture duration must be positive")
+	}
+
+	if err := a.profilerLock.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer a.profilerLock.Unlock()
+
+	a.log("Capturing CPU profile for %v.", duration)
+	return a.cpuReporter.readCPUProfileContext(ctx, int64(duration/time.Millisecond))
+}
+
+//CaptureBlockProfile enables block profiling for the given duration on
+// demand and returns the block profile. Like CaptureCPUProfile, it is
+// serialized with scheduled profiler runs.
+func (a *Agent) CaptureBlockProfile(ctx context.Context, duration time.Duration) (*profile.Profile, error) {
+	if duration <= 0 {
+		return nil, errors.New("Capture duration must be positive")
+	}
+
+	if err := a.profilerLock.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer a.profilerLock.Unlock()
+
+	a.log("Capturing block profile for %v.", duration)
+	return a.blockReporter.readBlockProfileContext(ctx, int64(duration/time.Millisecond))
+}
+
+//CaptureHeapProfile returns the current heap profile. Reading the heap
+// profile does not change runtime settings, so it does not wait for
+// scheduled profiler runs.
+func (a *Agent) CaptureHeapProfile(ctx context.Context) (*profile.Profile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.log("Capturing heap profile.")
+	return a.allocationReporter.readHeapProfile()
+}
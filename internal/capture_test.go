@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCaptureCPUProfile(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5000000; i++ {
+			str := "str" + strconv.Itoa(i)
+			_ = str + "a"
+		}
+
+		done <- true
+	}()
+
+	p, err := agent.CaptureCPUProfile(context.Background(), 500*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(p.Sample) == 0 {
+		t.Error("CPU profile should have samples")
+	}
+
+	<-done
+}
+
+func TestCaptureWaitsForProfilerLock(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	agent.profilerLock.Lock()
+	defer agent.profilerLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := agent.CaptureCPUProfile(ctx, 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("Capture should wait for the profiler lock and time out, but returned %v", err)
+	}
+
+	if _, err := agent.CaptureBlockProfile(ctx, 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("Capture should wait for the profiler lock and time out, but returned %v", err)
+	}
+}
+
+func TestCaptureHeapProfile(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	p, err := agent.CaptureHeapProfile(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(p.SampleType) == 0 {
+		t.Error("Heap profile should have sample types")
+	}
+}
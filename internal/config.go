@@ -1,14 +1,45 @@
 package internal
 
 import (
+	"fmt"
 	"sync"
 )
 
+//ProfilerCPU ...
+const ProfilerCPU string = "cpu"
+
+//ProfilerBlock ...
+const ProfilerBlock string = "block"
+
+//ProfilerHeap ...
+const ProfilerHeap string = "heap"
+
+//ProfilerErrors ...
+const ProfilerErrors string = "errors"
+
+//ProfilerSegments ...
+const ProfilerSegments string = "segments"
+
+//ProfilerProcess ...
+const ProfilerProcess string = "process"
+
+//Profilers lists all profilers and reporters that can be switched on and off.
+var Profilers = []string{
+	ProfilerCPU,
+	ProfilerBlock,
+	ProfilerHeap,
+	ProfilerErrors,
+	ProfilerSegments,
+	ProfilerProcess,
+}
+
 //Config ...
 type Config struct {
 	agent             *Agent
 	configLock        *sync.RWMutex
 	profilingDisabled bool
+	profilingPaused   bool
+	disabledProfilers map[string]bool
 }
 
 func newConfig(agent *Agent) *Config {
@@ -16,6 +47,8 @@ func newConfig(agent *Agent) *Config {
 		agent:             agent,
 		configLock:        &sync.RWMutex{},
 		profilingDisabled: false,
+		profilingPaused:   false,
+		disabledProfilers: make(map[string]bool),
 	}
 
 	return c
@@ -34,3 +67,60 @@ func (c *Config) isProfilingDisabled() bool {
 
 	return c.profilingDisabled
 }
+
+func (c *Config) setProfilingPaused(val bool) {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+
+	c.profilingPaused = val
+}
+
+func (c *Config) isProfilingPaused() bool {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+
+	return c.profilingPaused
+}
+
+func (c *Config) setProfilerEnabled(profiler string, enabled bool) error {
+	if !isKnownProfiler(profiler) {
+		return fmt.Errorf("Unknown profiler %q", profiler)
+	}
+
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+
+	if enabled {
+		delete(c.disabledProfilers, profiler)
+	} else {
+		c.disabledProfilers[profiler] = true
+	}
+
+	return nil
+}
+
+func (c *Config) isProfilerEnabled(profiler string) bool {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+
+	return !c.disabledProfilers[profiler]
+}
+
+// isProfilingActive tells if the CPU, block or heap profiler may run. These
+// profilers are also stopped by pausing and by the dashboard config.
+func (c *Config) isProfilingActive(profiler string) bool {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+
+	return !c.profilingDisabled && !c.profilingPaused && !c.disabledProfilers[profiler]
+}
+
+func isKnownProfiler(profiler string) bool {
+	for _, p := range Profilers {
+		if p == profiler {
+			return true
+		}
+	}
+
+	return false
+}
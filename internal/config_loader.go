@@ -1,58 +1,94 @@
 package internal
 
 import (
+	"sync"
 	"time"
 )
 
 //ConfigLoader ...
 type ConfigLoader struct {
-	agent *Agent
+	agent    *Agent
+	stopChan chan bool
+	runGroup *sync.WaitGroup
 }
 
 func newConfigLoader(agent *Agent) *ConfigLoader {
 	cl := &ConfigLoader{
-		agent: agent,
+		agent:    agent,
+		stopChan: nil,
+		runGroup: &sync.WaitGroup{},
 	}
 
 	return cl
 }
 
 func (cl *ConfigLoader) start() {
-	// return
+	cl.stopChan = make(chan bool)
+	stopChan := cl.stopChan
+
 	loadDelay := time.NewTimer(500 * time.Millisecond)
+	cl.runGroup.Add(1)
 	go func() {
+		defer cl.runGroup.Done()
 		defer cl.agent.recoverAndLog()
 
-		<-loadDelay.C
-		cl.load()
+		select {
+		case <-loadDelay.C:
+			cl.load()
+		case <-stopChan:
+			loadDelay.Stop()
+		}
 	}()
 
 	loadTicker := time.NewTicker(120 * time.Second)
+	cl.runGroup.Add(1)
 	go func() {
+		defer cl.runGroup.Done()
 		defer cl.agent.recoverAndLog()
+		defer loadTicker.Stop()
 
 		for {
 			select {
 			case <-loadTicker.C:
 				cl.load()
+			case <-stopChan:
+				return
 			}
 		}
 	}()
 }
 
+// stop stops the config loading and waits for an in-flight load to finish.
+func (cl *ConfigLoader) stop() {
+	if cl.stopChan != nil {
+		close(cl.stopChan)
+		cl.stopChan = nil
+	}
+
+	cl.runGroup.Wait()
+}
+
 func (cl *ConfigLoader) load() {
-	// cl.agent.config.setProfilingDisabled(false)
-	return
+	if cl.agent.DashboardAddress == "" {
+		return
+	}
+
 	payload := map[string]interface{}{}
 	if config, err := cl.agent.apiRequest.post("config", payload); err == nil {
 		// profiling_enabled yes|no
 		if profilingDisabled, exists := config["profiling_disabled"]; exists {
-			cl.agent.config.setProfilingDisabled(profilingDisabled.(string) == "yes")
+			v, ok := profilingDisabled.(string)
+			if !ok {
+				cl.agent.warn("Invalid profiling_disabled value in config from Dashboard: %v", profilingDisabled)
+				return
+			}
+
+			cl.agent.config.setProfilingDisabled(v == "yes")
 		} else {
 			cl.agent.config.setProfilingDisabled(false)
 		}
 	} else {
-		cl.agent.log("Error loading config from Dashboard")
+		cl.agent.warn("Error loading config from Dashboard")
 		cl.agent.error(err)
 	}
 }
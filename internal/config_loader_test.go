@@ -26,3 +26,23 @@ func TestConfigLoad(t *testing.T) {
 		t.Errorf("Config loading wasn't successful")
 	}
 }
+
+func TestConfigLoadInvalid(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"profiling_disabled\":true}")
+	}))
+	defer server.Close()
+
+	agent := NewAgent()
+	agent.AgentKey = "key1"
+	agent.AppName = "App1"
+	agent.HostName = "Host1"
+	agent.Debug = true
+	agent.DashboardAddress = server.URL
+
+	agent.configLoader.load()
+
+	if agent.config.isProfilingDisabled() {
+		t.Errorf("Invalid profiling_disabled value should be ignored")
+	}
+}
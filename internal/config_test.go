@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProfilerEnabled(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	if err := agent.SetProfilerEnabled("unknown", false); err == nil {
+		t.Error("Unknown profiler should not be accepted")
+	}
+
+	agent.SetProfilerEnabled(ProfilerCPU, false)
+
+	if agent.config.isProfilingActive(ProfilerCPU) {
+		t.Error("CPU profiler should not be active")
+	}
+
+	if !agent.config.isProfilingActive(ProfilerBlock) {
+		t.Error("Block profiler should be active")
+	}
+
+	agent.SetProfilerEnabled(ProfilerCPU, true)
+	agent.PauseProfiling()
+
+	if agent.config.isProfilingActive(ProfilerCPU) || agent.config.isProfilingActive(ProfilerHeap) {
+		t.Error("Profilers should not be active when paused")
+	}
+
+	if !agent.config.isProfilerEnabled(ProfilerSegments) {
+		t.Error("Segments should not be affected by pause")
+	}
+
+	agent.ResumeProfiling()
+
+	if !agent.config.isProfilingActive(ProfilerCPU) {
+		t.Error("CPU profiler should be active after resume")
+	}
+}
+
+func TestSegmentsDisabled(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	agent.SetProfilerEnabled(ProfilerSegments, false)
+	agent.segmentReporter.recordSegment("seg1", 10)
+
+	if len(agent.segmentReporter.segmentNodes) != 0 {
+		t.Error("Segment should not be recorded when segments are disabled")
+	}
+
+	agent.SetProfilerEnabled(ProfilerErrors, false)
+	agent.errorReporter.recordError("group1", errors.New("error1"), 0)
+
+	if len(agent.errorReporter.errorGraphs) != 0 {
+		t.Error("Error should not be recorded when errors are disabled")
+	}
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -30,7 +31,7 @@ func newCPUReporter(agent *Agent) *CPUReporter {
 		profileDuration:   0,
 	}
 
-	cr.profilerScheduler = newProfilerScheduler(agent, 10000, 2000, 120000,
+	cr.profilerScheduler = newProfilerScheduler(agent, "CPU profiler", 10000, 2000, 120000,
 		func(duration int64) {
 			cr.record(duration)
 		},
@@ -47,17 +48,22 @@ func (cr *CPUReporter) start() {
 	cr.profilerScheduler.start()
 }
 
+func (cr *CPUReporter) stop() {
+	cr.profilerScheduler.stop()
+}
+
 func (cr *CPUReporter) reset() {
 	cr.profile = newBreakdownNode("root")
 	cr.profileDuration = 0
 }
 
 func (cr *CPUReporter) record(duration int64) {
-	if cr.agent.config.isProfilingDisabled() {
+	if !cr.agent.config.isProfilingActive(ProfilerCPU) {
 		return
 	}
 
 	cr.agent.log("Starting CPU profiler.")
+	start := time.Now()
 	p, e := cr.readCPUProfile(duration)
 	if e != nil {
 		cr.agent.error(e)
@@ -68,6 +74,8 @@ func (cr *CPUReporter) record(duration int64) {
 	}
 	cr.agent.log("CPU profiler stopped.")
 
+	cr.agent.publishProfile(ProfilerCPU, start, time.Now(), p)
+
 	if err := cr.updateCPUProfile(p); err != nil {
 		cr.agent.error(err)
 	}
@@ -76,18 +84,26 @@ func (cr *CPUReporter) record(duration int64) {
 }
 
 func (cr *CPUReporter) report() {
-	if cr.agent.config.isProfilingDisabled() {
+	if !cr.agent.config.isProfilingActive(ProfilerCPU) {
+		cr.agent.metricCollector.updateFunctions(ProfilerCPU, UnitPercent, nil, nil)
+		cr.reset()
+		return
+	}
+
+	if cr.profileDuration == 0 {
 		return
 	}
 
 	cr.profile.convertToPercentage(float64(cr.profileDuration * 1e6 * int64(runtime.NumCPU())))
+	cr.agent.publishTopFunctions(ProfilerCPU, UnitPercent, cr.profile)
 
 	// filter calls with lower than 1% CPU stake
 	cr.profile.filter(2, 1, 100)
 
 	metric := newMetric(cr.agent, TypeProfile, CategoryCPUProfile, NameCPUUsage, UnitPercent)
 	metric.createMeasurement(TriggerTimer, cr.profile.measurement, 0, cr.profile)
-	cr.agent.messageQueue.addMessage("metric", metric.toMap())
+	cr.agent.publishMetric(metric)
+	cr.agent.stats.recordReport(ProfilerCPU)
 
 	cr.reset()
 }
@@ -137,6 +153,12 @@ func (cr *CPUReporter) updateCPUProfile(p *profile.Profile) error {
 }
 
 func (cr *CPUReporter) readCPUProfile(duration int64) (*profile.Profile, error) {
+	return cr.readCPUProfileContext(context.Background(), duration)
+}
+
+// readCPUProfileContext profiles CPU for duration milliseconds. If ctx is
+// done earlier, the profiler is stopped and ctx.Err() is returned.
+func (cr *CPUReporter) readCPUProfileContext(ctx context.Context, duration int64) (*profile.Profile, error) {
 	var buf bytes.Buffer
 	w := bufio.NewWriter(&buf)
 
@@ -147,25 +169,22 @@ func (cr *CPUReporter) readCPUProfile(duration int64) (*profile.Profile, error)
 		return nil, err
 	}
 
-	done := make(chan bool)
 	timer := time.NewTimer(time.Duration(duration) * time.Millisecond)
-	go func() {
-		defer cr.agent.recoverAndLog()
-
-		<-timer.C
-
+	select {
+	case <-timer.C:
 		pprof.StopCPUProfile()
-
-		done <- true
-	}()
-	<-done
+	case <-ctx.Done():
+		timer.Stop()
+		pprof.StopCPUProfile()
+		return nil, ctx.Err()
+	}
 
 	w.Flush()
 	r := bufio.NewReader(&buf)
 
 	var p *profile.Profile
 	var perr error
-	if p, perr = profile.Parse(r); perr == nil {
+	if p, perr = cr.agent.parseProfile(r); perr == nil {
 		if p.TimeNanos == 0 {
 			p.TimeNanos = start.UnixNano()
 		}
@@ -173,10 +192,6 @@ func (cr *CPUReporter) readCPUProfile(duration int64) (*profile.Profile, error)
 			p.DurationNanos = duration * 1e6
 		}
 
-		if serr := symbolizeProfile(p); serr != nil {
-			return nil, serr
-		}
-
 		if verr := p.CheckValid(); verr != nil {
 			return nil, verr
 		}
@@ -49,7 +49,7 @@ func TestCreateCallGraph(t *testing.T) {
 	if callGraph.numSamples < 1 {
 		t.Error("Number of samples should be > 0")
 	}
-	if !strings.Contains(fmt.Sprintf("%v", callGraph.toMap()), "TestCreateCallGraph") {
+	if !strings.Contains(wireJSON(t, callGraph.toPayload()), "TestCreateCallGraph") {
 		t.Error("The test function is not found in the profile")
 	}
 
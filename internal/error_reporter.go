@@ -2,16 +2,36 @@ package internal
 
 import (
 	"fmt"
+	"regexp"
 	"runtime"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
+//MaxErrorClasses is the number of error classes counted per error group.
+const MaxErrorClasses = 20
+
+const maxErrorClassLength = 100
+
+var errorClassPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`"[^"]*"|'[^']*'|` + "`[^`]*`"), `"*"`},
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), "<uuid>"},
+	{regexp.MustCompile(`0x[0-9a-fA-F]+`), "<hex>"},
+	{regexp.MustCompile(`[0-9]+`), "<n>"},
+}
+
 //ErrorReporter ...
 type ErrorReporter struct {
 	agent       *Agent
 	recordLock  *sync.RWMutex
 	errorGraphs map[string]*BreakdownNode
+	errorIDs    map[string]string
+	stopChan    chan bool
+	runGroup    *sync.WaitGroup
 }
 
 func newErrorReporter(agent *Agent) *ErrorReporter {
@@ -19,25 +39,46 @@ func newErrorReporter(agent *Agent) *ErrorReporter {
 		agent:       agent,
 		recordLock:  &sync.RWMutex{},
 		errorGraphs: make(map[string]*BreakdownNode),
+		errorIDs:    make(map[string]string),
+		stopChan:    nil,
+		runGroup:    &sync.WaitGroup{},
 	}
 
 	return er
 }
 
 func (er *ErrorReporter) start() {
+	er.stopChan = make(chan bool)
+	stopChan := er.stopChan
+
 	reportTicker := time.NewTicker(60 * time.Second)
+	er.runGroup.Add(1)
 	go func() {
+		defer er.runGroup.Done()
 		defer er.agent.recoverAndLog()
+		defer reportTicker.Stop()
 
 		for {
 			select {
 			case <-reportTicker.C:
 				er.report()
+			case <-stopChan:
+				return
 			}
 		}
 	}()
 }
 
+// stop stops the error reporting and waits for an in-flight report.
+func (er *ErrorReporter) stop() {
+	if er.stopChan != nil {
+		close(er.stopChan)
+		er.stopChan = nil
+	}
+
+	er.runGroup.Wait()
+}
+
 func callerFrames(skip int) []string {
 	stack := make([]uintptr, 50)
 	runtime.Callers(skip+2, stack)
@@ -85,7 +126,34 @@ func (er *ErrorReporter) incrementError(group string, errorGraph *BreakdownNode,
 	messageNode.increment(1, 0)
 }
 
+// errorClass normalizes an error message to a label value. Quoted strings,
+// UUIDs and numbers are replaced by placeholders, so messages that differ in
+// IDs, addresses or sizes fall into one class.
+func errorClass(err error) string {
+	class := err.Error()
+	if class == "" {
+		return "Undefined"
+	}
+
+	for _, p := range errorClassPatterns {
+		class = p.pattern.ReplaceAllString(class, p.replacement)
+	}
+
+	if len(class) > maxErrorClassLength {
+		class = class[:maxErrorClassLength]
+		for !utf8.ValidString(class) {
+			class = class[:len(class)-1]
+		}
+	}
+
+	return class
+}
+
 func (er *ErrorReporter) recordError(group string, err error, skip int) {
+	if !er.agent.config.isProfilerEnabled(ProfilerErrors) {
+		return
+	}
+
 	frames := callerFrames(skip + 1)
 
 	if err == nil {
@@ -96,6 +164,7 @@ func (er *ErrorReporter) recordError(group string, err error, skip int) {
 	// Error graph exists for the current interval.
 	er.recordLock.RLock()
 	errorGraph, exists := er.errorGraphs[group]
+	measurementID := er.errorIDs[group]
 	if exists {
 		er.incrementError(group, errorGraph, err, frames)
 	}
@@ -109,24 +178,38 @@ func (er *ErrorReporter) recordError(group string, err error, skip int) {
 			// If segment was not created by other recordError call between locks, create it.
 			errorGraph = newBreakdownNode(group)
 			er.errorGraphs[group] = errorGraph
+			er.errorIDs[group] = er.agent.uuid()
 		}
+		measurementID = er.errorIDs[group]
 		er.recordLock.Unlock()
 
 		er.recordLock.RLock()
 		er.incrementError(group, errorGraph, err, frames)
 		er.recordLock.RUnlock()
 	}
+
+	// The counter's exemplar is the ID of the group's error profile
+	// measurement of the current interval.
+	class := er.agent.metricCollector.incrementError(group, err, measurementID)
+	er.agent.statsdExporter.incrementError(group, class)
 }
 
 func (er *ErrorReporter) report() {
 	er.recordLock.Lock()
 	outgoing := er.errorGraphs
+	outgoingIDs := er.errorIDs
 	er.errorGraphs = make(map[string]*BreakdownNode)
+	er.errorIDs = make(map[string]string)
 	er.recordLock.Unlock()
 
+	if !er.agent.config.isProfilerEnabled(ProfilerErrors) {
+		return
+	}
+
 	for _, errorGraph := range outgoing {
 		metric := newMetric(er.agent, TypeState, CategoryErrorProfile, errorGraph.name, UnitNone)
-		metric.createMeasurement(TriggerTimer, errorGraph.measurement, 60, errorGraph)
-		er.agent.messageQueue.addMessage("metric", metric.toMap())
+		metric.createMeasurementWithID(outgoingIDs[errorGraph.name], TriggerTimer, errorGraph.measurement, 60, errorGraph)
+		er.agent.publishMetric(metric)
 	}
+	er.agent.stats.recordReport(ProfilerErrors)
 }
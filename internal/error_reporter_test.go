@@ -2,27 +2,30 @@ package internal
 
 import (
 	"errors"
-	"fmt"
 	"strings"
+	"sync"
 	"testing"
-	"time"
 )
 
 func TestRecordError(t *testing.T) {
 	agent := NewAgent()
 	agent.Debug = true
 
+	wg := &sync.WaitGroup{}
 	for i := 0; i < 100; i++ {
+		wg.Add(2)
 		go func() {
+			defer wg.Done()
 			agent.errorReporter.recordError("group1", errors.New("error1"), 0)
 
 			go func() {
+				defer wg.Done()
 				agent.errorReporter.recordError("group1", errors.New("error2"), 0)
 			}()
 		}()
 	}
 
-	time.Sleep(50 * time.Millisecond)
+	wg.Wait()
 
 	errorGraphs := agent.errorReporter.errorGraphs
 
@@ -31,7 +34,27 @@ func TestRecordError(t *testing.T) {
 		t.Errorf("Measurement is wrong: %v", group1.measurement)
 	}
 
-	if !strings.Contains(fmt.Sprintf("%v", group1.toMap()), "TestRecordError.func1.1") {
+	if !strings.Contains(wireJSON(t, group1.toPayload()), "TestRecordError.func1.1") {
 		t.Error("The test function is not found in the error profile")
 	}
 }
+
+func TestErrorClass(t *testing.T) {
+	classes := map[string]string{
+		"": "Undefined",
+		"dial tcp 10.0.0.1:5432: connection refused":          "dial tcp <n>.<n>.<n>.<n>:<n>: connection refused",
+		`open "/tmp/a.txt": no such file`:                     `open "*": no such file`,
+		"user 6ba7b810-9dad-11d1-80b4-00c04fd430c8 not found": "user <uuid> not found",
+		"invalid pointer 0xc420298740":                        "invalid pointer <hex>",
+	}
+
+	for message, expected := range classes {
+		if class := errorClass(errors.New(message)); class != expected {
+			t.Errorf("Class of %q should be %q, but is %q", message, expected, class)
+		}
+	}
+
+	if class := errorClass(errors.New(strings.Repeat("é", 100))); len(class) > maxErrorClassLength {
+		t.Errorf("Class should be truncated, but has length %v", len(class))
+	}
+}
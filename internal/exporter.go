@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"context"
+)
+
+//Exporter receives the messages flushed by MessageQueue. If Export returns
+// an error, the messages are put back into the queue and the next flush is
+// delayed by a backoff of up to one minute.
+type Exporter interface {
+	Export(ctx context.Context, messages []Message) error
+}
+
+//HTTPExporter uploads messages to the dashboard as gzipped JSON with
+// POST <DashboardAddress>/agent/v1/upload. Requests carry the AgentKey as
+// basic auth user, the runtime and app metadata envelope and go through
+// ProxyAddress, if set.
+type HTTPExporter struct {
+	agent *Agent
+}
+
+func newHTTPExporter(agent *Agent) *HTTPExporter {
+	he := &HTTPExporter{
+		agent: agent,
+	}
+
+	return he
+}
+
+//Export implements Exporter.
+func (he *HTTPExporter) Export(ctx context.Context, messages []Message) error {
+	payload := map[string]interface{}{
+		"messages": messages,
+	}
+
+	_, err := he.agent.apiRequest.postContext(ctx, "upload", payload)
+	return err
+}
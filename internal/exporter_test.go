@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPExporterExport(t *testing.T) {
+	var path, user, encoding string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, encoding = r.URL.Path, r.Header.Get("Content-Encoding")
+		user, _, _ = r.BasicAuth()
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := json.NewDecoder(zr).Decode(&body); err != nil {
+			t.Error(err)
+			return
+		}
+
+		fmt.Fprintf(w, "{}")
+	}))
+	defer server.Close()
+
+	agent := NewAgent()
+	agent.AgentKey = "key1"
+	agent.AppName = "App1"
+	agent.DashboardAddress = server.URL
+
+	messages := []Message{
+		testMessage(1),
+		testMessage(2),
+	}
+
+	if err := agent.exporter().Export(context.Background(), messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/agent/v1/upload" || user != "key1" || encoding != "gzip" {
+		t.Errorf("Invalid upload request: %v %v %v", path, user, encoding)
+	}
+
+	if body["app_name"] != "App1" || body["run_id"] != agent.runID {
+		t.Errorf("Invalid envelope: %v", body)
+	}
+
+	payload := body["payload"].(map[string]interface{})
+	if len(payload["messages"].([]interface{})) != 2 {
+		t.Errorf("Invalid payload: %v", payload)
+	}
+}
+
+type testExporter struct {
+	messages []Message
+	exports  int
+	err      error
+	started  chan bool
+	wait     chan bool
+}
+
+func (te *testExporter) Export(ctx context.Context, messages []Message) error {
+	if te.started != nil {
+		te.started <- true
+	}
+
+	if te.wait != nil {
+		<-te.wait
+	}
+
+	if te.err != nil {
+		return te.err
+	}
+
+	te.exports++
+	te.messages = append(te.messages, messages...)
+	return nil
+}
+
+func TestFlushExporter(t *testing.T) {
+	agent := NewAgent()
+	exporter := &testExporter{err: errors.New("unavailable")}
+	agent.Exporter = exporter
+
+	agent.messageQueue.addMessage(testMessage(1))
+	agent.messageQueue.flush()
+
+	if len(agent.messageQueue.queue) != 1 || agent.messageQueue.backoffDelay == 0 {
+		t.Errorf("Failed export should be requeued with backoff")
+	}
+
+	exporter.err = nil
+	agent.messageQueue.flush()
+
+	if len(agent.messageQueue.queue) != 0 || len(exporter.messages) != 1 {
+		t.Errorf("Message should be exported, but queue has %v", len(agent.messageQueue.queue))
+	}
+
+	if exporter.messages[0].Topic != TopicMetric || testMessageValue(exporter.messages[0]) != 1 {
+		t.Errorf("Invalid message: %v", exporter.messages[0])
+	}
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DefaultExportFileMaxSize is the default size at which ExportFile is
+// rotated, 16 MB.
+const DefaultExportFileMaxSize int64 = 16 << 20
+
+//DefaultExportFileMaxFiles is the default number of rotated files kept.
+const DefaultExportFileMaxFiles int = 10
+
+// exportFileTimeFormat sorts rotated file names by time.
+const exportFileTimeFormat = "20060102T150405.000Z"
+
+//FileExporter appends the exported messages to ExportFile as JSON lines,
+// one message per line in the wire format of Message, for hosts without a
+// network path to a backend. When the file would grow beyond
+// ExportFileMaxSize it is rotated: renamed to <name>-<time><ext>, e.g.
+// messages-20261016T101500.000Z.jsonl, and gzipped. A file rotated within
+// the same millisecond as an existing one gets the next free millisecond,
+// so names stay unique and sorted by time. Of the rotated files,
+// the ExportFileMaxFiles newest are kept. ReplayFiles exports the files
+// with another exporter later.
+type FileExporter struct {
+	agent     *Agent
+	file      *os.File
+	size      int64
+	writeLock *sync.Mutex
+}
+
+func newFileExporter(agent *Agent) *FileExporter {
+	fe := &FileExporter{
+		agent:     agent,
+		file:      nil,
+		size:      0,
+		writeLock: &sync.Mutex{},
+	}
+
+	return fe
+}
+
+//Export implements Exporter.
+func (fe *FileExporter) Export(ctx context.Context, messages []Message) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, m := range messages {
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+
+	if fe.file == nil {
+		if err := fe.open(); err != nil {
+			return err
+		}
+	}
+
+	maxSize := fe.agent.ExportFileMaxSize
+	if maxSize > 0 && fe.size > 0 && fe.size+int64(buf.Len()) > maxSize {
+		if err := fe.rotate(time.Now()); err != nil {
+			return err
+		}
+		if err := fe.open(); err != nil {
+			return err
+		}
+	}
+
+	// The batch is written in one call, so a crash leaves at most a partial
+	// last line, which ReplayFiles skips.
+	n, err := fe.file.Write(buf.Bytes())
+	fe.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return fe.file.Sync()
+}
+
+func (fe *FileExporter) open() error {
+	if err := os.MkdirAll(filepath.Dir(fe.agent.ExportFile), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fe.agent.ExportFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	fe.file = f
+	fe.size = info.Size()
+
+	return nil
+}
+
+// rotate renames the current file, compresses all rotated files that are
+// not compressed yet, e.g. after a crash, and removes the oldest ones
+// beyond ExportFileMaxFiles.
+func (fe *FileExporter) rotate(now time.Time) error {
+	if err := fe.file.Close(); err != nil {
+		return err
+	}
+	fe.file = nil
+	fe.size = 0
+
+	dir, name := filepath.Split(fe.agent.ExportFile)
+	ext := filepath.Ext(name)
+
+	// Rename replaces existing files, so a name that is taken, compressed
+	// or not, is advanced to the next millisecond.
+	var rotated string
+	for {
+		rotated = strings.TrimSuffix(name, ext) + "-" + now.UTC().Format(exportFileTimeFormat) + ext
+		if !fileExists(filepath.Join(dir, rotated)) && !fileExists(filepath.Join(dir, rotated+".gz")) {
+			break
+		}
+		now = now.Add(time.Millisecond)
+	}
+
+	if err := os.Rename(fe.agent.ExportFile, filepath.Join(dir, rotated)); err != nil {
+		return err
+	}
+	fe.agent.log("Export file rotated to %v", rotated)
+
+	files, err := fe.rotatedFiles()
+	if err != nil {
+		return err
+	}
+
+	for i, f := range files {
+		if !strings.HasSuffix(f, ".gz") {
+			if err := compressFile(f); err != nil {
+				return err
+			}
+			files[i] = f + ".gz"
+		}
+	}
+
+	maxFiles := fe.agent.ExportFileMaxFiles
+	for maxFiles > 0 && len(files) > maxFiles {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fe.agent.log("Export file %v removed", files[0])
+		files = files[1:]
+	}
+
+	return nil
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Lstat(fileName)
+	return !os.IsNotExist(err)
+}
+
+// rotatedFiles returns the paths of the rotated files of ExportFile, oldest
+// first.
+func (fe *FileExporter) rotatedFiles() ([]string, error) {
+	dir, name := filepath.Split(fe.agent.ExportFile)
+	ext := filepath.Ext(name)
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(strings.TrimSuffix(name, ext)) +
+		`-\d{8}T\d{6}\.\d{3}Z` + regexp.QuoteMeta(ext) + `(\.gz)?$`)
+
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	for _, info := range infos {
+		if info.Mode().IsRegular() && pattern.MatchString(info.Name()) {
+			files = append(files, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func (fe *FileExporter) close() {
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+
+	if fe.file != nil {
+		if err := fe.file.Close(); err != nil {
+			fe.agent.error(err)
+		}
+		fe.file = nil
+	}
+}
+
+// compressFile writes fileName to fileName.gz, through a temporary file so
+// readers never see partial files, and removes fileName.
+func compressFile(fileName string) error {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if zerr := zw.Close(); err == nil {
+		err = zerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), fileName+".gz")
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	return os.Remove(fileName)
+}
+
+//ReplayFiles exports the messages of files written by FileExporter,
+// gzipped if their name ends with .gz, with Exporter or the dashboard
+// exporter in batches of QueueBatchSize. ExportFile is not an exporter for
+// replays, and is refused as input, since the agent may append to it.
+// Lines that cannot be decoded or have another WireVersion are skipped.
+// ReplayFiles returns the number of exported messages and stops at the
+// first failed export, so repeating a replay may export messages twice.
+func (a *Agent) ReplayFiles(ctx context.Context, fileNames ...string) (int, error) {
+	exporter := a.replayExporter()
+	if exporter == nil {
+		return 0, errors.New("No exporter to replay messages to, set Exporter or DashboardAddress")
+	}
+
+	if a.ExportFile != "" {
+		if active, err := os.Stat(a.ExportFile); err == nil {
+			for _, fileName := range fileNames {
+				if info, err := os.Stat(fileName); err == nil && os.SameFile(info, active) {
+					return 0, fmt.Errorf("Cannot replay the active export file %v", fileName)
+				}
+			}
+		}
+	}
+
+	batchSize := a.messageQueue.batchSize()
+	batch := make([]Message, 0, batchSize)
+	exported := 0
+
+	export := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := exporter.Export(ctx, batch); err != nil {
+			return err
+		}
+		exported += len(batch)
+		batch = make([]Message, 0, batchSize)
+
+		return nil
+	}
+
+	for _, fileName := range fileNames {
+		invalid, err := readMessageFile(fileName, func(m Message) error {
+			if batch = append(batch, m); len(batch) < batchSize {
+				return nil
+			}
+			return export()
+		})
+		if err != nil {
+			return exported, err
+		}
+
+		if invalid > 0 {
+			a.warn("Skipped %v invalid lines in %v", invalid, fileName)
+		}
+	}
+
+	if err := export(); err != nil {
+		return exported, err
+	}
+
+	return exported, nil
+}
+
+// replayExporter returns the exporter of ReplayFiles, which is the exporter
+// of the message queue without the file exporter.
+func (a *Agent) replayExporter() Exporter {
+	if a.Exporter != nil {
+		return a.Exporter
+	}
+
+	if a.DashboardAddress != "" {
+		return a.httpExporter
+	}
+
+	return nil
+}
+
+// readMessageFile calls message with every message of a file written by
+// FileExporter and returns the number of skipped lines.
+func readMessageFile(fileName string, message func(m Message) error) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(fileName, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	invalid := 0
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return invalid, err
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			var m Message
+			if jerr := json.Unmarshal(line, &m); jerr != nil || m.Version != WireVersion {
+				invalid++
+			} else if merr := message(m); merr != nil {
+				return invalid, merr
+			}
+		}
+
+		if err == io.EOF {
+			return invalid, nil
+		}
+	}
+}
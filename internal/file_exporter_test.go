@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileExporterRotate(t *testing.T) {
+	dir := t.TempDir()
+
+	agent := NewAgent()
+	agent.ExportFile = filepath.Join(dir, "messages.jsonl")
+	agent.ExportFileMaxSize = int64(len(wireJSON(t, testMessage(0)))+1) * 3
+	agent.ExportFileMaxFiles = 2
+
+	if agent.exporter() != agent.fileExporter {
+		t.Fatalf("ExportFile should select the file exporter")
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := agent.fileExporter.Export(context.Background(), []Message{testMessage(2 * i), testMessage(2*i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	agent.fileExporter.close()
+
+	files, err := agent.fileExporter.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 rotated files, got %v", files)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".jsonl.gz") {
+			t.Errorf("Rotated file %v is not compressed", f)
+		}
+	}
+
+	// the current file is replayed by an agent that does not write to it
+	exporter := &testExporter{}
+	replay := NewAgent()
+	replay.Exporter = exporter
+	n, err := replay.ReplayFiles(context.Background(), append(files, agent.ExportFile)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first rotated file was removed
+	if n != 6 || len(exporter.messages) != 6 {
+		t.Fatalf("Expected 6 replayed messages, got %v", n)
+	}
+	for i, m := range exporter.messages {
+		if testMessageValue(m) != float64(i+2) {
+			t.Errorf("Message %v has value %v", i, testMessageValue(m))
+		}
+	}
+}
+
+func TestFileExporterRotateSameTime(t *testing.T) {
+	dir := t.TempDir()
+
+	agent := NewAgent()
+	agent.ExportFile = filepath.Join(dir, "messages.jsonl")
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := agent.fileExporter.Export(context.Background(), []Message{testMessage(i)}); err != nil {
+			t.Fatal(err)
+		}
+
+		agent.fileExporter.writeLock.Lock()
+		err := agent.fileExporter.rotate(now)
+		agent.fileExporter.writeLock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := agent.fileExporter.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := filepath.Base(files[len(files)-1])
+	if len(files) != 3 || last != "messages-"+now.Add(2*time.Millisecond).UTC().Format(exportFileTimeFormat)+".jsonl.gz" {
+		t.Fatalf("Expected 3 rotated files in consecutive milliseconds, got %v", files)
+	}
+
+	exporter := &testExporter{}
+	replay := NewAgent()
+	replay.Exporter = exporter
+	if _, err := replay.ReplayFiles(context.Background(), files...); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range exporter.messages {
+		if testMessageValue(m) != float64(i) {
+			t.Errorf("Message %v has value %v", i, testMessageValue(m))
+		}
+	}
+	if len(exporter.messages) != 3 {
+		t.Errorf("Expected 3 replayed messages, got %v", len(exporter.messages))
+	}
+}
+
+func TestReplayFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	agent := NewAgent()
+	agent.ExportFile = filepath.Join(dir, "messages.jsonl")
+
+	messages := make([]Message, 5)
+	for i := range messages {
+		messages[i] = testMessage(i)
+	}
+	if err := agent.fileExporter.Export(context.Background(), messages); err != nil {
+		t.Fatal(err)
+	}
+	agent.fileExporter.close()
+
+	// partial line of a crash and a message of another version
+	f, err := os.OpenFile(agent.ExportFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"version":99,"topic":"metric"}` + "\n" + `{"version":1,"top`)
+	f.Close()
+
+	if _, err := agent.ReplayFiles(context.Background(), agent.ExportFile); err == nil {
+		t.Errorf("ExportFile should not be a replay exporter")
+	}
+
+	exporter := &testExporter{}
+	agent.Exporter = exporter
+	agent.QueueBatchSize = 2
+
+	if _, err := agent.ReplayFiles(context.Background(), agent.ExportFile); err == nil || exporter.exports != 0 {
+		t.Errorf("Replay of the active export file should fail")
+	}
+
+	fileName := agent.ExportFile
+	agent.ExportFile = ""
+	n, err := agent.ReplayFiles(context.Background(), fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 5 || exporter.exports != 3 {
+		t.Errorf("Expected 5 messages in 3 batches, got %v in %v", n, exporter.exports)
+	}
+	for i, m := range exporter.messages {
+		if testMessageValue(m) != float64(i) {
+			t.Errorf("Message %v has value %v", i, testMessageValue(m))
+		}
+	}
+
+	if _, err := agent.ReplayFiles(context.Background(), filepath.Join(dir, "missing.jsonl")); err == nil {
+		t.Errorf("Replay of a missing file should fail")
+	}
+}
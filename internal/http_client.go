@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//DefaultHTTPTimeout is the default time limit of an HTTP request including
+// its retries.
+const DefaultHTTPTimeout time.Duration = 20 * time.Second
+
+//DefaultHTTPMaxRetries is the default number of retries of failed HTTP
+// requests.
+const DefaultHTTPMaxRetries int = 2
+
+// httpRetryDelay is the delay before the first retry. It doubles on every
+// further retry up to httpRetryMaxDelay, and a random part of up to half
+// of it is subtracted.
+var httpRetryDelay = time.Second
+var httpRetryMaxDelay = 30 * time.Second
+
+//HTTPClient is the HTTP client shared by the dashboard upload, the OTLP,
+// Pushgateway and ingest exporters. It is created on first use and reuses
+// connections. Requests go through ProxyAddress and trust HTTPCAFile instead
+// of the system roots, if set, and present the client certificate of
+// HTTPCertFile and HTTPKeyFile. HTTPBearerToken and HTTPHeaders are added
+// to every request.
+//
+// Network errors, 429 and 5xx responses are retried HTTPMaxRetries times
+// with an exponential backoff with jitter, or after the Retry-After delay of
+// the response. HTTPTimeout limits a request including its retries.
+type HTTPClient struct {
+	agent      *Agent
+	client     *http.Client
+	transport  *http.Transport
+	clientLock *sync.Mutex
+}
+
+func newHTTPClient(agent *Agent) *HTTPClient {
+	hc := &HTTPClient{
+		agent:      agent,
+		client:     nil,
+		transport:  nil,
+		clientLock: &sync.Mutex{},
+	}
+
+	return hc
+}
+
+// get returns the shared client, created from the options on first use.
+func (hc *HTTPClient) get() (*http.Client, error) {
+	hc.clientLock.Lock()
+	defer hc.clientLock.Unlock()
+
+	if hc.client != nil {
+		return hc.client, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 4
+
+	if hc.agent.ProxyAddress != "" {
+		proxyURL, err := url.Parse(hc.agent.ProxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := hc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := hc.agent.HTTPTimeout
+	if timeout <= 0 {
+		timeout = DefaultHTTPTimeout
+	}
+
+	hc.transport = transport
+	hc.client = &http.Client{
+		Transport: &retryTransport{agent: hc.agent, transport: transport},
+		Timeout:   timeout,
+	}
+
+	return hc.client, nil
+}
+
+// stop closes idle connections.
+func (hc *HTTPClient) stop() {
+	hc.clientLock.Lock()
+	defer hc.clientLock.Unlock()
+
+	if hc.transport != nil {
+		hc.transport.CloseIdleConnections()
+	}
+}
+
+func (hc *HTTPClient) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if hc.agent.HTTPCAFile != "" {
+		pem, err := ioutil.ReadFile(hc.agent.HTTPCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", hc.agent.HTTPCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if hc.agent.HTTPCertFile != "" || hc.agent.HTTPKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(hc.agent.HTTPCertFile, hc.agent.HTTPKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+type noRetryKey struct{}
+
+// withoutRetries returns a context for requests that are retried by the
+// caller, e.g. to stop retrying on Stop.
+func withoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// retryTransport adds the configured headers to requests and retries
+// failed ones.
+type retryTransport struct {
+	agent     *Agent
+	transport http.RoundTripper
+}
+
+//RoundTrip implements http.RoundTripper.
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	maxRetries := rt.agent.HTTPMaxRetries
+	if ctx.Value(noRetryKey{}) != nil {
+		maxRetries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		r := req.Clone(ctx)
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errors.New("Request body cannot be retried")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		if rt.agent.HTTPBearerToken != "" {
+			r.Header.Set("Authorization", "Bearer "+rt.agent.HTTPBearerToken)
+		}
+		for name, value := range rt.agent.HTTPHeaders {
+			r.Header.Set(name, value)
+		}
+
+		res, err := rt.transport.RoundTrip(r)
+		if (err == nil && !retryableStatus(res.StatusCode)) || (err != nil && !retryableError(err)) || ctx.Err() != nil || attempt >= maxRetries {
+			return res, err
+		}
+
+		wait := httpRetryWait(attempt, res)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return res, err
+		}
+
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			rt.agent.log("Retrying request to %v in %v: received %v", req.URL.Host, wait, res.StatusCode)
+		} else {
+			rt.agent.log("Retrying request to %v in %v: %v", req.URL.Host, wait, err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// retryableError returns false for certificate errors, which do not go away
+// on retry.
+func retryableError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	return !errors.As(err, &verificationErr)
+}
+
+// httpRetryWait returns the delay before retry attempt+1, the Retry-After
+// delay of res, if set, or the backoff with jitter.
+func httpRetryWait(attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+			if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			if t, err := http.ParseTime(retryAfter); err == nil {
+				if wait := time.Until(t); wait > 0 {
+					return wait
+				}
+				return 0
+			}
+		}
+	}
+
+	delay := httpRetryDelay
+	for i := 0; i < attempt && delay < httpRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > httpRetryMaxDelay {
+		delay = httpRetryMaxDelay
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
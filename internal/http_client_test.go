@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to
+// dir and returns the certificate.
+func writeClientCert(t *testing.T, dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "profile-agent"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, "client.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "client-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestHTTPClientTLS(t *testing.T) {
+	defer func(d time.Duration) { httpRetryDelay = d }(httpRetryDelay)
+	httpRetryDelay = time.Millisecond
+
+	dir := t.TempDir()
+	clientCert := writeClientCert(t, dir)
+
+	lock := &sync.Mutex{}
+	var header http.Header
+	remoteAddrs := make(map[string]bool)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		header = r.Header
+		remoteAddrs[r.RemoteAddr] = true
+		lock.Unlock()
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	agent := NewAgent()
+	agent.HTTPCAFile = caFile
+	agent.HTTPCertFile = filepath.Join(dir, "client.pem")
+	agent.HTTPKeyFile = filepath.Join(dir, "client-key.pem")
+	agent.HTTPBearerToken = "token1"
+	agent.HTTPHeaders = map[string]string{"X-Scope-OrgID": "team-1"}
+
+	httpClient, err := agent.httpClient.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.httpClient.stop()
+
+	for i := 0; i < 3; i++ {
+		res, err := httpClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	lock.Lock()
+	if header.Get("Authorization") != "Bearer token1" || header.Get("X-Scope-OrgID") != "team-1" {
+		t.Errorf("Missing headers: %v", header)
+	}
+	if len(remoteAddrs) != 1 {
+		t.Errorf("Connection should be reused, but requests came from %v", remoteAddrs)
+	}
+	lock.Unlock()
+
+	// without the CA, the server certificate is not trusted
+	noCA := NewAgent()
+	noCA.HTTPCertFile = agent.HTTPCertFile
+	noCA.HTTPKeyFile = agent.HTTPKeyFile
+	if httpClient, err = noCA.httpClient.get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := httpClient.Get(server.URL); err == nil {
+		t.Errorf("Request without the CA should fail")
+	}
+
+	// without the client certificate, the server rejects the handshake
+	noCert := NewAgent()
+	noCert.HTTPCAFile = caFile
+	if httpClient, err = noCert.httpClient.get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := httpClient.Get(server.URL); err == nil {
+		t.Errorf("Request without the client certificate should fail")
+	}
+}
+
+func TestHTTPClientRetry(t *testing.T) {
+	defer func(d time.Duration) { httpRetryDelay = d }(httpRetryDelay)
+	httpRetryDelay = time.Millisecond
+
+	lock := &sync.Mutex{}
+	failures := 2
+	bodies := make([]string, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		bodies = append(bodies, string(body))
+		if failures > 0 {
+			failures--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	agent := NewAgent()
+	httpClient, err := agent.httpClient.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := httpClient.Post(server.URL, "text/plain", bytes.NewReader([]byte("data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	lock.Lock()
+	if res.StatusCode != http.StatusOK || len(bodies) != 3 || bodies[2] != "data" {
+		t.Errorf("Request should succeed on the third attempt with its body, but got %v after %v", res.StatusCode, bodies)
+	}
+	failures = 5
+	bodies = bodies[:0]
+	lock.Unlock()
+
+	res, err = httpClient.Post(server.URL, "text/plain", bytes.NewReader([]byte("data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	lock.Lock()
+	if res.StatusCode != http.StatusServiceUnavailable || len(bodies) != DefaultHTTPMaxRetries+1 {
+		t.Errorf("Request should give up after %v retries, but got %v after %v attempts", DefaultHTTPMaxRetries, res.StatusCode, len(bodies))
+	}
+	failures = 5
+	bodies = bodies[:0]
+	lock.Unlock()
+
+	req, _ := http.NewRequestWithContext(withoutRetries(context.Background()), "GET", server.URL, nil)
+	if res, err = httpClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	lock.Lock()
+	if len(bodies) != 1 {
+		t.Errorf("Request without retries was made %v times", len(bodies))
+	}
+	lock.Unlock()
+}
+
+func TestHTTPRetryWait(t *testing.T) {
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Set("Retry-After", "7")
+	if wait := httpRetryWait(0, res); wait != 7*time.Second {
+		t.Errorf("Retry-After seconds not respected: %v", wait)
+	}
+
+	res.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if wait := httpRetryWait(0, res); wait < 58*time.Second || wait > time.Minute {
+		t.Errorf("Retry-After date not respected: %v", wait)
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		max := httpRetryDelay << uint(attempt)
+		if max > httpRetryMaxDelay {
+			max = httpRetryMaxDelay
+		}
+
+		if wait := httpRetryWait(attempt, nil); wait < max/2 || wait > max {
+			t.Errorf("Backoff %v of attempt %v is not between %v and %v", wait, attempt, max/2, max)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+//DefaultIngestConcurrency is the default number of concurrent profile uploads.
+const DefaultIngestConcurrency int = 2
+
+//DefaultIngestMaxRetries is the default number of retries of a failed upload.
+const DefaultIngestMaxRetries int = 3
+
+//IngestUploader uploads every CPU, block and heap profile read by the
+// reporters in pprof format to a continuous profiling ingest endpoint
+// compatible with Pyroscope's HTTP API:
+//
+//	POST <IngestAddress>/ingest?name=<AppName>{labels}&from=<unix>&until=<unix>&format=pprof
+//
+// Labels are hostname, version and environment, where set, and IngestLabels.
+// Uploads run in the background, at most IngestConcurrency at a time;
+// profiles read while all uploads are busy are dropped. Network errors, 429
+// and 5xx responses are retried up to IngestMaxRetries times, instead of
+// HTTPMaxRetries, with the backoff of HTTPClient.
+type IngestUploader struct {
+	agent       *Agent
+	semaphore   chan bool
+	uploadGroup *sync.WaitGroup
+	stopChan    chan bool
+	stopLock    *sync.Mutex
+}
+
+func newIngestUploader(agent *Agent) *IngestUploader {
+	iu := &IngestUploader{
+		agent:       agent,
+		semaphore:   nil,
+		uploadGroup: &sync.WaitGroup{},
+		stopChan:    make(chan bool),
+		stopLock:    &sync.Mutex{},
+	}
+
+	return iu
+}
+
+// upload starts the upload of a profile read between start and end. The
+// profile is serialized before upload returns, so the caller may continue
+// to use it.
+func (iu *IngestUploader) upload(profiler string, start time.Time, end time.Time, p *profile.Profile) {
+	if iu.agent.IngestAddress == "" {
+		return
+	}
+
+	iu.stopLock.Lock()
+	if iu.semaphore == nil {
+		concurrency := iu.agent.IngestConcurrency
+		if concurrency <= 0 {
+			concurrency = DefaultIngestConcurrency
+		}
+		iu.semaphore = make(chan bool, concurrency)
+	}
+	semaphore := iu.semaphore
+	stopChan := iu.stopChan
+	iu.stopLock.Unlock()
+
+	select {
+	case semaphore <- true:
+	default:
+		iu.agent.stats.recordExportFailure(errors.New("Ingest concurrency limit reached"))
+		iu.agent.warn("Dropping %v profile, %v uploads in progress", profiler, cap(semaphore))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		<-semaphore
+		iu.agent.error(err)
+		return
+	}
+
+	iu.uploadGroup.Add(1)
+	go func() {
+		defer iu.agent.recoverAndLog()
+		defer iu.uploadGroup.Done()
+		defer func() { <-semaphore }()
+
+		if err := iu.send(stopChan, start, end, buf.Bytes()); err != nil {
+			iu.agent.stats.recordExportFailure(err)
+			iu.agent.warn("Error uploading %v profile", profiler)
+			iu.agent.error(err)
+		}
+	}()
+}
+
+// send posts the profile and retries failed attempts. Retries are skipped
+// once the uploader is stopped.
+func (iu *IngestUploader) send(stopChan chan bool, start time.Time, end time.Time, data []byte) error {
+	for attempt := 0; ; attempt++ {
+		retry, delay, err := iu.post(attempt, start, end, data)
+		if err == nil || !retry {
+			return err
+		}
+
+		if attempt >= iu.agent.IngestMaxRetries {
+			return err
+		}
+
+		iu.agent.log("Retrying profile upload in %v: %v", delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-stopChan:
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// post makes one upload attempt and tells if a failed attempt can be
+// retried and after which delay.
+func (iu *IngestUploader) post(attempt int, start time.Time, end time.Time, data []byte) (bool, time.Duration, error) {
+	query := url.Values{}
+	query.Set("name", iu.name())
+	query.Set("from", strconv.FormatInt(start.Unix(), 10))
+	query.Set("until", strconv.FormatInt(end.Unix(), 10))
+	query.Set("format", "pprof")
+	query.Set("spyName", "gospy")
+
+	u := iu.agent.IngestAddress + "/ingest?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(withoutRetries(context.Background()), "POST", u, bytes.NewReader(data))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	iu.agent.log("Uploading profile to %v", iu.agent.IngestAddress)
+
+	httpClient, err := iu.agent.httpClient.get()
+	if err != nil {
+		return false, 0, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return true, httpRetryWait(attempt, nil), err
+	}
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		return true, httpRetryWait(attempt, nil), err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return retryableStatus(res.StatusCode), httpRetryWait(attempt, res), fmt.Errorf("Received %v: %v", res.StatusCode, string(resBody))
+	}
+
+	return false, 0, nil
+}
+
+// name returns the application name with labels, e.g.
+// App1{environment=prod,hostname=host1}. Labels are sorted by key and
+// characters of the label syntax are removed from names and values.
+func (iu *IngestUploader) name() string {
+	labels := make(map[string]string)
+	if iu.agent.HostName != "" {
+		labels["hostname"] = iu.agent.HostName
+	}
+	if iu.agent.AppVersion != "" {
+		labels["version"] = iu.agent.AppVersion
+	}
+	if iu.agent.AppEnvironment != "" {
+		labels["environment"] = iu.agent.AppEnvironment
+	}
+	for k, v := range iu.agent.IngestLabels {
+		labels[k] = v
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if ingestLabelValue(k) != "" && ingestLabelValue(labels[k]) != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, ingestLabelValue(k)+"="+ingestLabelValue(labels[k]))
+	}
+
+	return ingestLabelValue(iu.agent.AppName) + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func ingestLabelValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '{', '}', ',', '=', ' ', '\t', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// stop cancels pending retries and waits for running uploads.
+func (iu *IngestUploader) stop() {
+	iu.stopLock.Lock()
+	close(iu.stopChan)
+	iu.stopChan = make(chan bool)
+	iu.stopLock.Unlock()
+
+	iu.uploadGroup.Wait()
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+// fakeIngestServer is a local ingest endpoint. It answers the first failures
+// requests with failureStatus, blocks requests while block is open and
+// records the parsed profiles of the other requests.
+type fakeIngestServer struct {
+	*httptest.Server
+	lock          *sync.Mutex
+	requests      int
+	uploads       []fakeIngestUpload
+	failures      int
+	failureStatus int
+	block         chan bool
+}
+
+type fakeIngestUpload struct {
+	name    string
+	from    string
+	until   string
+	format  string
+	profile *profile.Profile
+}
+
+func newFakeIngestServer() *fakeIngestServer {
+	fs := &fakeIngestServer{
+		lock:          &sync.Mutex{},
+		uploads:       make([]fakeIngestUpload, 0),
+		failureStatus: http.StatusServiceUnavailable,
+	}
+
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		fs.requests++
+		fail := fs.failures > 0
+		if fail {
+			fs.failures--
+		}
+		block := fs.block
+		fs.lock.Unlock()
+
+		if block != nil {
+			<-block
+		}
+
+		if r.Method != http.MethodPost || r.URL.Path != "/ingest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if fail {
+			w.WriteHeader(fs.failureStatus)
+			return
+		}
+
+		p, err := profile.Parse(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		fs.lock.Lock()
+		fs.uploads = append(fs.uploads, fakeIngestUpload{
+			name:    query.Get("name"),
+			from:    query.Get("from"),
+			until:   query.Get("until"),
+			format:  query.Get("format"),
+			profile: p,
+		})
+		fs.lock.Unlock()
+	}))
+
+	return fs
+}
+
+func (fs *fakeIngestServer) readRequests() (int, []fakeIngestUpload) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return fs.requests, fs.uploads
+}
+
+func newIngestTestAgent(t *testing.T, address string) (*Agent, *profile.Profile) {
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.AppEnvironment = "prod"
+	agent.HostName = "Host1"
+	agent.IngestAddress = address
+	agent.IngestLabels = map[string]string{"region": "eu-1"}
+
+	p, err := agent.allocationReporter.readHeapProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return agent, p
+}
+
+func TestIngestUpload(t *testing.T) {
+	server := newFakeIngestServer()
+	defer server.Close()
+
+	agent, p := newIngestTestAgent(t, server.URL)
+
+	start := time.Unix(1760000000, 0)
+	agent.ingestUploader.upload(ProfilerHeap, start, start.Add(10*time.Second), p)
+	agent.ingestUploader.stop()
+
+	_, uploads := server.readRequests()
+	if len(uploads) != 1 {
+		t.Fatalf("Expected one upload, but got %v", len(uploads))
+	}
+
+	u := uploads[0]
+	if u.name != "App1{environment=prod,hostname=Host1,region=eu-1}" {
+		t.Errorf("Invalid name: %v", u.name)
+	}
+	if u.from != "1760000000" || u.until != "1760000010" || u.format != "pprof" {
+		t.Errorf("Invalid range or format: %v %v %v", u.from, u.until, u.format)
+	}
+	if len(u.profile.Sample) != len(p.Sample) {
+		t.Errorf("Uploaded profile differs, %v samples instead of %v", len(u.profile.Sample), len(p.Sample))
+	}
+}
+
+func TestIngestRetry(t *testing.T) {
+	defer func(d time.Duration) { httpRetryDelay = d }(httpRetryDelay)
+	httpRetryDelay = time.Millisecond
+
+	server := newFakeIngestServer()
+	defer server.Close()
+	server.failures = 2
+
+	agent, p := newIngestTestAgent(t, server.URL)
+	agent.IngestMaxRetries = 2
+
+	agent.ingestUploader.upload(ProfilerHeap, time.Now(), time.Now(), p)
+	agent.ingestUploader.uploadGroup.Wait()
+
+	requests, uploads := server.readRequests()
+	if requests != 3 || len(uploads) != 1 {
+		t.Errorf("Upload should succeed on the third attempt, but had %v requests and %v uploads", requests, len(uploads))
+	}
+
+	if agent.stats.readExportFailures() != 0 {
+		t.Errorf("Retried upload should not be counted as failure")
+	}
+
+	// Client errors are not retried.
+	server.failures = 1
+	server.failureStatus = http.StatusBadRequest
+
+	agent.ingestUploader.upload(ProfilerHeap, time.Now(), time.Now(), p)
+	agent.ingestUploader.uploadGroup.Wait()
+
+	if requests, _ = server.readRequests(); requests != 4 {
+		t.Errorf("Client error should not be retried, but had %v requests", requests)
+	}
+
+	if agent.stats.readExportFailures() != 1 {
+		t.Errorf("Failed upload should be counted, but failures are %v", agent.stats.readExportFailures())
+	}
+}
+
+func TestIngestConcurrency(t *testing.T) {
+	server := newFakeIngestServer()
+	defer server.Close()
+	server.block = make(chan bool)
+
+	agent, p := newIngestTestAgent(t, server.URL)
+	agent.IngestConcurrency = 1
+
+	agent.ingestUploader.upload(ProfilerHeap, time.Now(), time.Now(), p)
+	agent.ingestUploader.upload(ProfilerHeap, time.Now(), time.Now(), p)
+
+	close(server.block)
+	agent.ingestUploader.stop()
+
+	if _, uploads := server.readRequests(); len(uploads) != 1 {
+		t.Errorf("Second upload should be dropped, but got %v uploads", len(uploads))
+	}
+
+	if agent.stats.readExportFailures() != 1 {
+		t.Errorf("Dropped upload should be counted, but failures are %v", agent.stats.readExportFailures())
+	}
+}
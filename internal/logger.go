@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"log/slog"
+	"os"
+)
+
+//Logger receives all agent log messages. Key-value pairs follow the
+// log/slog conventions, so *slog.Logger satisfies Logger.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (nopLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Error(msg string, keysAndValues ...interface{}) {}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+//NewSlogLogger returns a Logger writing to logger. Every record carries the
+// agent version, levels are mapped to the corresponding slog levels.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &slogLogger{
+		logger: logger.With("agent", "profileagent", "agent_version", AgentVersion),
+	}
+}
+
+func (sl *slogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	sl.logger.Debug(msg, keysAndValues...)
+}
+
+func (sl *slogLogger) Info(msg string, keysAndValues ...interface{}) {
+	sl.logger.Info(msg, keysAndValues...)
+}
+
+func (sl *slogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	sl.logger.Warn(msg, keysAndValues...)
+}
+
+func (sl *slogLogger) Error(msg string, keysAndValues ...interface{}) {
+	sl.logger.Error(msg, keysAndValues...)
+}
+
+// debugLogger is used when Debug is set and no Logger is configured.
+var debugLogger = NewSlogLogger(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	Level: slog.LevelDebug,
+})))
@@ -1,152 +1,396 @@
 package internal
 
 import (
-	"log"
+	"context"
+	"encoding/json"
 	"sync"
 	"time"
 )
 
-//Message ...
+//DefaultQueueMaxMessages is the default limit of queued messages.
+const DefaultQueueMaxMessages int = 10000
+
+//DefaultQueueMaxSize is the default limit of the JSON encoded size of queued
+// messages, 16 MB.
+const DefaultQueueMaxSize int64 = 16 << 20
+
+//DefaultQueueBatchSize is the default maximum number of messages per export.
+const DefaultQueueBatchSize int = 1000
+
+//QueueDropOldest - QueueDropPolicy that drops the oldest messages to make
+// room in a full queue.
+const QueueDropOldest string = "drop-oldest"
+
+//QueueDropNewest - QueueDropPolicy that drops new messages while the queue
+// is full.
+const QueueDropNewest string = "drop-newest"
+
+// queueExpiry is the age after which queued messages are dropped.
+const queueExpiry int64 = 10 * 60
+
+// queueBackoffMin is the delay of the next flush after a failed export. It
+// doubles on every further failure up to queueBackoffMax.
+var queueBackoffMin = 10 * time.Second
+var queueBackoffMax = 60 * time.Second
+
+//Message is a queued report in version Version of the wire format, e.g. a
+// metric with topic TopicMetric and the metric as payload. AddedAt is a Unix
+// timestamp in seconds. See message.schema.json for the JSON and
+// message.proto for the protobuf encoding.
 type Message struct {
-	topic         string
-	content       map[string]interface{}
-	contentString []string
-	addedAt       int64
+	Version int            `json:"version"`
+	Topic   string         `json:"topic"`
+	AddedAt int64          `json:"added_at"`
+	Metric  *MetricPayload `json:"metric,omitempty"`
 }
 
-//MessageQueue  ...
+// queuedMessage is a message with its JSON encoded size.
+type queuedMessage struct {
+	Message
+	size int64
+}
+
+//MessageQueue holds messages in memory until they are exported, limited to
+// QueueMaxMessages messages and QueueMaxSize bytes. If the queue is full,
+// QueueDropPolicy decides whether the oldest or the new messages are
+// dropped. A background flush exports the messages every second in batches
+// of QueueBatchSize. After a failed export the messages are kept and
+// flushes are delayed by an exponential backoff.
 type MessageQueue struct {
-	agent               *Agent
-	queue               []Message
-	queueLock           *sync.Mutex
-	lastUploadTimestamp int64
-	backoffSeconds      int
+	agent        *Agent
+	queue        []queuedMessage
+	queueSize    int64
+	queueLock    *sync.Mutex
+	flushLock    *sync.Mutex
+	backoffDelay time.Duration
+	nextFlush    time.Time
+	stopChan     chan bool
+	runGroup     *sync.WaitGroup
 }
 
 func newMessageQueue(agent *Agent) *MessageQueue {
 	mq := &MessageQueue{
-		agent:               agent,
-		queue:               make([]Message, 0),
-		queueLock:           &sync.Mutex{},
-		lastUploadTimestamp: 0,
-		backoffSeconds:      0,
+		agent:        agent,
+		queue:        make([]queuedMessage, 0),
+		queueSize:    0,
+		queueLock:    &sync.Mutex{},
+		flushLock:    &sync.Mutex{},
+		backoffDelay: 0,
+		nextFlush:    time.Time{},
+		stopChan:     nil,
+		runGroup:     &sync.WaitGroup{},
 	}
 
 	return mq
 }
 
 func (mq *MessageQueue) start() {
+	mq.stopChan = make(chan bool)
+	stopChan := mq.stopChan
+
 	flushTicker := time.NewTicker(1 * time.Second)
 
+	mq.runGroup.Add(1)
 	go func() {
+		defer mq.runGroup.Done()
 		defer mq.agent.recoverAndLog()
+		defer flushTicker.Stop()
 
 		for {
 			select {
 			case <-flushTicker.C:
-				mq.queueLock.Lock()
-				l := len(mq.queue)
-				mq.queueLock.Unlock()
-
-				// if l > 0 && (mq.lastUploadTimestamp+int64(mq.backoffSeconds) < time.Now().Unix()) {
-				if l > 0 {
+				if mq.size() > 0 && mq.ready() {
 					mq.expire()
 					mq.flush()
 				}
-				// }
+			case <-stopChan:
+				return
 			}
 		}
 	}()
 }
 
+// stop stops the background flush and waits for an in-flight flush to finish.
+func (mq *MessageQueue) stop() {
+	if mq.stopChan != nil {
+		close(mq.stopChan)
+		mq.stopChan = nil
+	}
+
+	mq.runGroup.Wait()
+}
+
+// size returns the number of queued and spooled messages.
+func (mq *MessageQueue) size() int {
+	mq.queueLock.Lock()
+	l := len(mq.queue)
+	mq.queueLock.Unlock()
+
+	if mq.agent.messageSpool.enabled() {
+		l += int(mq.agent.messageSpool.readPending())
+	}
+
+	return l
+}
+
+// ready returns false while flushes are delayed after a failed export.
+func (mq *MessageQueue) ready() bool {
+	mq.queueLock.Lock()
+	defer mq.queueLock.Unlock()
+
+	return !time.Now().Before(mq.nextFlush)
+}
+
 func (mq *MessageQueue) expire() {
 	now := time.Now().Unix()
 
 	mq.queueLock.Lock()
+	expired := 0
 	for i := len(mq.queue) - 1; i >= 0; i-- {
-		if mq.queue[i].addedAt < now-10*60 {
-			mq.queue = mq.queue[i+1:]
+		if mq.queue[i].AddedAt < now-queueExpiry {
+			expired = i + 1
 			break
 		}
 	}
+	for _, m := range mq.queue[:expired] {
+		mq.queueSize -= m.size
+	}
+	mq.queue = mq.queue[expired:]
 	mq.queueLock.Unlock()
+
+	if expired > 0 {
+		mq.agent.stats.recordQueueDrops(expired)
+		mq.agent.log("Dropped %v expired messages", expired)
+	}
 }
 
+// flush exports the queued messages in batches of at most QueueBatchSize,
+// oldest first. After a failed export the remaining messages are kept and
+// the backoff is increased. Without an exporter the messages are dropped,
+// unless they are spooled.
 func (mq *MessageQueue) flush() {
-	log.Println("Flushing the queue")
+	mq.flushLock.Lock()
+	defer mq.flushLock.Unlock()
+
+	mq.agent.log("Flushing the queue")
+
+	if mq.agent.messageSpool.enabled() {
+		mq.flushSpool()
+		return
+	}
+
+	exporter := mq.agent.exporter()
+	if exporter == nil {
+		if outgoing := mq.take(-1); len(outgoing) > 0 {
+			mq.agent.log("No exporter, dropping %v messages", len(outgoing))
+		}
+		return
+	}
+
+	for {
+		outgoing := mq.take(mq.batchSize())
+		if len(outgoing) == 0 {
+			return
+		}
+
+		messages := make([]Message, len(outgoing))
+		for i, m := range outgoing {
+			messages[i] = m.Message
+		}
+
+		mq.agent.log("Exporting %v messages", len(messages))
+		if err := exporter.Export(context.Background(), messages); err != nil {
+			mq.requeue(outgoing)
+			mq.agent.stats.recordQueueRetries(len(outgoing))
+			mq.backoff(err)
+			return
+		}
+		mq.resetBackoff()
+	}
+}
+
+// flushSpool exports the spooled messages in batches, oldest first. The
+// queued messages, which could not be spooled when added, are spooled
+// first. Without an exporter the messages are kept in the spool.
+func (mq *MessageQueue) flushSpool() {
+	spool := mq.agent.messageSpool
+
+	outgoing := mq.take(-1)
+	for i, m := range outgoing {
+		if err := spool.append(m.Message); err != nil {
+			mq.requeue(outgoing[i:])
+			mq.agent.error(err)
+			break
+		}
+	}
+
+	if err := spool.sync(); err != nil {
+		mq.agent.error(err)
+	}
+
+	exporter := mq.agent.exporter()
+	if exporter == nil {
+		mq.agent.log("No exporter, keeping %v spooled messages", spool.readPending())
+		return
+	}
+
+	for {
+		batch, err := spool.read(mq.batchSize())
+		if err != nil {
+			mq.agent.error(err)
+			return
+		}
+
+		if len(batch.messages) == 0 && batch.invalid == 0 {
+			return
+		}
+
+		if len(batch.messages) > 0 {
+			mq.agent.log("Exporting %v spooled messages", len(batch.messages))
+			if err := exporter.Export(context.Background(), batch.messages); err != nil {
+				mq.agent.stats.recordQueueRetries(len(batch.messages))
+				mq.backoff(err)
+				return
+			}
+			mq.resetBackoff()
+		}
+
+		if err := spool.commit(batch); err != nil {
+			mq.agent.error(err)
+			return
+		}
+	}
+}
+
+// take removes and returns up to max of the oldest messages, all if max is
+// negative.
+func (mq *MessageQueue) take(max int) []queuedMessage {
 	mq.queueLock.Lock()
-	outgoing := mq.queue
-	mq.queue = make([]Message, 0)
-	mq.queueLock.Unlock()
+	defer mq.queueLock.Unlock()
 
-	messages := make([]interface{}, 0)
-	payload := make([]string, 0)
+	n := len(mq.queue)
+	if max >= 0 && max < n {
+		n = max
+	}
+
+	outgoing := make([]queuedMessage, n)
+	copy(outgoing, mq.queue[:n])
+	mq.queue = mq.queue[n:]
 	for _, m := range outgoing {
-		message := map[string]interface{}{
-			"topic":   m.topic,
-			"content": m.content,
-		}
+		mq.queueSize -= m.size
+	}
+
+	return outgoing
+}
 
-		messages = append(messages, message)
-		payload = append(payload, m.contentString...)
-	}
-
-	// for _, msg := range mq.queue {
-	// 	payload = append(payload, msg.contentString...)
-	// }
-	// payload := map[string]interface{}{
-	// 	"messages": messages,
-	// }
-
-	mq.lastUploadTimestamp = time.Now().Unix()
-	log.Println("uploading the queue")
-	if _, err := mq.agent.apiRequest.push("upload", payload); err == nil {
-		// reset backoff
-		mq.backoffSeconds = 0
-	} else {
-		// prepend outgoing messages back to the queue
-		mq.queueLock.Lock()
-		mq.queue = append(outgoing, mq.queue...)
-		mq.queueLock.Unlock()
-
-		// increase backoff up to 1 minute
-		mq.agent.log("Error uploading messages to dashboard, backing off next upload")
-		if mq.backoffSeconds == 0 {
-			mq.backoffSeconds = 10
-		} else if mq.backoffSeconds*2 < 60 {
-			mq.backoffSeconds *= 2
+// requeue puts messages back at the front of the queue. Messages added in
+// the meantime may not fit anymore and are dropped by QueueDropPolicy.
+func (mq *MessageQueue) requeue(outgoing []queuedMessage) {
+	mq.queueLock.Lock()
+	mq.queue = append(append(make([]queuedMessage, 0, len(outgoing)+len(mq.queue)), outgoing...), mq.queue...)
+	for _, m := range outgoing {
+		mq.queueSize += m.size
+	}
+	dropped := mq.enforceLimits()
+	mq.queueLock.Unlock()
+
+	mq.recordDrops(dropped)
+}
+
+// enforceLimits drops messages by QueueDropPolicy until the queue is within
+// QueueMaxMessages and QueueMaxSize and returns their number. It must be
+// called with queueLock held.
+func (mq *MessageQueue) enforceLimits() int {
+	maxMessages := mq.agent.QueueMaxMessages
+	maxSize := mq.agent.QueueMaxSize
+
+	dropped := 0
+	for len(mq.queue) > 0 && ((maxMessages > 0 && len(mq.queue) > maxMessages) || (maxSize > 0 && mq.queueSize > maxSize)) {
+		var m queuedMessage
+		if mq.agent.QueueDropPolicy == QueueDropNewest {
+			m = mq.queue[len(mq.queue)-1]
+			mq.queue = mq.queue[:len(mq.queue)-1]
+		} else {
+			m = mq.queue[0]
+			mq.queue = mq.queue[1:]
 		}
+		mq.queueSize -= m.size
+		dropped++
+	}
 
-		log.Println("ERR: ", err)
+	return dropped
+}
+
+func (mq *MessageQueue) recordDrops(dropped int) {
+	if dropped == 0 {
+		return
+	}
+
+	if mq.agent.stats.recordQueueDrops(dropped)%1000 < int64(dropped) {
+		mq.agent.warn("Message queue is full, dropping messages with policy %v", mq.agent.QueueDropPolicy)
 	}
 }
-func (mq *MessageQueue) pushMessage(topic string, messages []string) {
-	defer mq.flush()
-	m := Message{
-		topic:         topic,
-		contentString: messages,
-		addedAt:       time.Now().Unix(),
+
+func (mq *MessageQueue) batchSize() int {
+	if mq.agent.QueueBatchSize <= 0 {
+		return DefaultQueueBatchSize
 	}
 
+	return mq.agent.QueueBatchSize
+}
+
+func (mq *MessageQueue) resetBackoff() {
+	mq.queueLock.Lock()
+	mq.backoffDelay = 0
+	mq.nextFlush = time.Time{}
+	mq.queueLock.Unlock()
+}
+
+// backoff delays the next flush after a failed export, doubling the delay
+// from queueBackoffMin up to queueBackoffMax.
+func (mq *MessageQueue) backoff(err error) {
 	mq.queueLock.Lock()
-	mq.queue = append(mq.queue, m)
+	if mq.backoffDelay == 0 {
+		mq.backoffDelay = queueBackoffMin
+	} else if mq.backoffDelay *= 2; mq.backoffDelay > queueBackoffMax {
+		mq.backoffDelay = queueBackoffMax
+	}
+	mq.nextFlush = time.Now().Add(mq.backoffDelay)
+	delay := mq.backoffDelay
 	mq.queueLock.Unlock()
 
-	log.Printf("Added message to the queue for topic: %v", topic)
-	log.Printf("%v", messages)
+	mq.agent.stats.recordExportFailure(err)
+	mq.agent.warn("Error exporting messages, backing off next export for %v", delay)
+	mq.agent.error(err)
 }
 
-func (mq *MessageQueue) addMessage(topic string, message map[string]interface{}) {
-	m := Message{
-		topic:   topic,
-		content: message,
-		addedAt: time.Now().Unix(),
+func (mq *MessageQueue) addMessage(m Message) {
+	m.Version = WireVersion
+	m.AddedAt = time.Now().Unix()
+
+	if mq.agent.messageSpool.enabled() {
+		err := mq.agent.messageSpool.append(m)
+		if err == nil {
+			mq.agent.log("Spooled message for topic: %v", m.Topic)
+			return
+		}
+
+		mq.agent.warn("Error spooling message, keeping it in memory")
+		mq.agent.error(err)
+	}
+
+	size := int64(0)
+	if data, err := json.Marshal(m); err == nil {
+		size = int64(len(data))
 	}
 
 	mq.queueLock.Lock()
-	mq.queue = append(mq.queue, m)
+	mq.queue = append(mq.queue, queuedMessage{Message: m, size: size})
+	mq.queueSize += size
+	dropped := mq.enforceLimits()
 	mq.queueLock.Unlock()
 
-	mq.agent.log("Added message to the queue for topic: %v", topic)
-	mq.agent.log("%v", message)
+	mq.recordDrops(dropped)
+
+	mq.agent.log("Added message to the queue for topic: %v", m.Topic)
 }
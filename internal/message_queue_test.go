@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -12,24 +13,15 @@ func TestExpire(t *testing.T) {
 	agent := NewAgent()
 	agent.Debug = true
 
-	msg := map[string]interface{}{
-		"a": 1,
-	}
-
-	agent.messageQueue.addMessage("test", msg)
-
-	msg = map[string]interface{}{
-		"a": 2,
-	}
-
-	agent.messageQueue.addMessage("test", msg)
+	agent.messageQueue.addMessage(testMessage(1))
+	agent.messageQueue.addMessage(testMessage(2))
 
 	if len(agent.messageQueue.queue) != 2 {
 		t.Errorf("Message len is not 2, but %v", len(agent.messageQueue.queue))
 		return
 	}
 
-	agent.messageQueue.queue[0].addedAt = time.Now().Unix() - 20*60
+	agent.messageQueue.queue[0].AddedAt = time.Now().Unix() - 20*60
 
 	agent.messageQueue.expire()
 
@@ -52,15 +44,8 @@ func TestFlush(t *testing.T) {
 	agent.Debug = true
 	agent.DashboardAddress = server.URL
 
-	msg := map[string]interface{}{
-		"a": 1,
-	}
-	agent.messageQueue.addMessage("test", msg)
-
-	msg = map[string]interface{}{
-		"a": 2,
-	}
-	agent.messageQueue.addMessage("test", msg)
+	agent.messageQueue.addMessage(testMessage(1))
+	agent.messageQueue.addMessage(testMessage(2))
 
 	agent.messageQueue.flush()
 
@@ -82,19 +67,81 @@ func TestFlushFail(t *testing.T) {
 	agent.Debug = true
 	agent.DashboardAddress = server.URL
 
-	msg := map[string]interface{}{
-		"a": 1,
+	agent.messageQueue.addMessage(testMessage(1))
+	agent.messageQueue.addMessage(testMessage(2))
+
+	agent.messageQueue.flush()
+
+	if len(agent.messageQueue.queue) != 2 {
+		t.Errorf("Should have 2 messages, but has %v", len(agent.messageQueue.queue))
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	agent := NewAgent()
+	agent.QueueMaxMessages = 3
+
+	for i := 0; i < 5; i++ {
+		agent.messageQueue.addMessage(testMessage(i))
 	}
-	agent.messageQueue.addMessage("test", msg)
 
-	msg = map[string]interface{}{
-		"a": 2,
+	if len(agent.messageQueue.queue) != 3 || testMessageValue(agent.messageQueue.queue[0].Message) != 2 {
+		t.Errorf("Oldest messages should be dropped, but queue starts with %v", testMessageValue(agent.messageQueue.queue[0].Message))
+	}
+
+	agent.QueueMaxMessages = 0
+	agent.QueueMaxSize = agent.messageQueue.queueSize
+	agent.QueueDropPolicy = QueueDropNewest
+	agent.messageQueue.addMessage(testMessage(5))
+
+	if len(agent.messageQueue.queue) != 3 || testMessageValue(agent.messageQueue.queue[2].Message) != 4 {
+		t.Errorf("New message should be dropped, but queue ends with %v", testMessageValue(agent.messageQueue.queue[len(agent.messageQueue.queue)-1].Message))
+	}
+
+	if agent.stats.readQueueDropped() != 3 {
+		t.Errorf("Dropped messages should be counted, but are %v", agent.stats.readQueueDropped())
+	}
+}
+
+func TestFlushBatchBackoff(t *testing.T) {
+	defer func(min, max time.Duration) { queueBackoffMin, queueBackoffMax = min, max }(queueBackoffMin, queueBackoffMax)
+	queueBackoffMin = 10 * time.Second
+	queueBackoffMax = 30 * time.Second
+
+	agent := NewAgent()
+	agent.QueueBatchSize = 2
+	exporter := &testExporter{}
+	agent.Exporter = exporter
+
+	for i := 0; i < 5; i++ {
+		agent.messageQueue.addMessage(testMessage(i))
 	}
-	agent.messageQueue.addMessage("test", msg)
 
 	agent.messageQueue.flush()
 
-	if len(agent.messageQueue.queue) != 2 {
-		t.Errorf("Should have 2 messages, but has %v", len(agent.messageQueue.queue))
+	if len(exporter.messages) != 5 || exporter.exports != 3 {
+		t.Errorf("Messages should be exported in 3 batches, but got %v messages in %v exports", len(exporter.messages), exporter.exports)
+	}
+
+	exporter.err = errors.New("unavailable")
+	agent.messageQueue.addMessage(testMessage(5))
+
+	for _, delay := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		agent.messageQueue.flush()
+
+		if agent.messageQueue.backoffDelay != delay || agent.messageQueue.ready() {
+			t.Errorf("Backoff should be %v, but is %v", delay, agent.messageQueue.backoffDelay)
+		}
+	}
+
+	if agent.stats.readQueueRetried() != 4 || len(agent.messageQueue.queue) != 1 {
+		t.Errorf("Retried messages should be counted, but are %v", agent.stats.readQueueRetried())
+	}
+
+	exporter.err = nil
+	agent.messageQueue.flush()
+
+	if agent.messageQueue.backoffDelay != 0 || !agent.messageQueue.ready() || len(agent.messageQueue.queue) != 0 {
+		t.Errorf("Backoff should be reset after a successful export")
 	}
 }
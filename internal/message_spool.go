@@ -0,0 +1,533 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+//DefaultSpoolMaxSize is the default limit of the spool size, 64 MB.
+const DefaultSpoolMaxSize int64 = 64 << 20
+
+// spoolSegments is the number of segments the spool size is split into.
+// Dropping a segment when the spool is full drops at most this share of it.
+const spoolSegments int64 = 8
+
+const spoolCursorFile = "cursor.json"
+
+var spoolSegmentName = regexp.MustCompile(`^(\d{20})\.log$`)
+
+//MessageSpool keeps queued messages in SpoolDir, so they survive exporter
+// outages longer than the in-memory expiry and agent restarts. It is an
+// append-only log of JSON lines split into numbered segments. The cursor,
+// the segment and offset of the first message not yet exported, is saved
+// in cursor.json after every successful export, and segments before it are
+// removed. On start, messages after the cursor are replayed in order.
+//
+// If the spool exceeds SpoolMaxSize, the oldest segment is removed, also
+// if not yet exported, and its messages are counted as dropped.
+type MessageSpool struct {
+	agent     *Agent
+	segments  []*spoolSegment
+	cursor    spoolCursor
+	writer    *os.File
+	pending   int64
+	dropped   int64
+	opened    bool
+	spoolLock *sync.Mutex
+}
+
+type spoolSegment struct {
+	seq  int64
+	size int64
+}
+
+type spoolCursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+func (sc spoolCursor) before(other spoolCursor) bool {
+	return sc.Segment < other.Segment || (sc.Segment == other.Segment && sc.Offset < other.Offset)
+}
+
+// spoolBatch is a read of the messages from one cursor to another. Invalid
+// is the number of lines that could not be decoded, e.g. a partial last
+// line written before a crash or a message of another WireVersion. These
+// lines are skipped. Segments are the read counts per segment.
+type spoolBatch struct {
+	messages []Message
+	from     spoolCursor
+	to       spoolCursor
+	invalid  int64
+	segments []spoolBatchSegment
+}
+
+type spoolBatchSegment struct {
+	seq      int64
+	messages int64
+	invalid  int64
+}
+
+func newMessageSpool(agent *Agent) *MessageSpool {
+	ms := &MessageSpool{
+		agent:     agent,
+		segments:  make([]*spoolSegment, 0),
+		cursor:    spoolCursor{},
+		writer:    nil,
+		pending:   0,
+		dropped:   0,
+		opened:    false,
+		spoolLock: &sync.Mutex{},
+	}
+
+	return ms
+}
+
+func (ms *MessageSpool) enabled() bool {
+	return ms.agent.SpoolDir != ""
+}
+
+// start opens the spool, so spooled messages are counted from the start.
+func (ms *MessageSpool) start() {
+	if !ms.enabled() {
+		return
+	}
+
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	if err := ms.open(); err != nil {
+		ms.agent.error(err)
+	}
+}
+
+// open loads the segments and the cursor of SpoolDir and counts the
+// messages to replay. It is called once, on the first use of the spool.
+// It must be called with spoolLock held.
+func (ms *MessageSpool) open() error {
+	if ms.opened {
+		return nil
+	}
+
+	if err := os.MkdirAll(ms.agent.SpoolDir, 0755); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(ms.agent.SpoolDir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if match := spoolSegmentName.FindStringSubmatch(info.Name()); match != nil {
+			seq, _ := strconv.ParseInt(match[1], 10, 64)
+			ms.segments = append(ms.segments, &spoolSegment{seq: seq, size: info.Size()})
+		}
+	}
+	sort.Slice(ms.segments, func(i, j int) bool {
+		return ms.segments[i].seq < ms.segments[j].seq
+	})
+
+	data, err := ioutil.ReadFile(filepath.Join(ms.agent.SpoolDir, spoolCursorFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &ms.cursor); err != nil {
+			ms.agent.log("Invalid spool cursor, replaying all segments: %v", err)
+			ms.cursor = spoolCursor{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Remove exported segments left over by an interrupted commit.
+	for len(ms.segments) > 0 && ms.segments[0].seq < ms.cursor.Segment {
+		if err := ms.removeSegment(ms.segments[0]); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range ms.segments {
+		offset := int64(0)
+		if s.seq == ms.cursor.Segment {
+			offset = ms.cursor.Offset
+		}
+
+		n, err := ms.countLines(s, offset)
+		if err != nil {
+			return err
+		}
+		ms.pending += n
+	}
+
+	ms.opened = true
+
+	if ms.pending > 0 {
+		ms.agent.info("Replaying %v spooled messages", ms.pending)
+	}
+
+	return nil
+}
+
+// append writes a message to the last segment.
+func (ms *MessageSpool) append(m Message) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	if err := ms.open(); err != nil {
+		return err
+	}
+
+	// An unlimited spool is split as if it had the default limit.
+	maxSize := ms.agent.SpoolMaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultSpoolMaxSize
+	}
+
+	segmentSize := maxSize / spoolSegments
+	last := ms.lastSegment()
+	if ms.writer == nil || last == nil || (last.size > 0 && last.size+int64(len(line)) > segmentSize) {
+		if err := ms.rotate(); err != nil {
+			return err
+		}
+		last = ms.lastSegment()
+	}
+
+	n, err := ms.writer.Write(line)
+	last.size += int64(n)
+	if err != nil {
+		return err
+	}
+	ms.pending++
+
+	return ms.enforceMaxSize()
+}
+
+// rotate starts a new segment. After a restart, a new segment is started
+// instead of appending to the last one, which may end with a partial line.
+func (ms *MessageSpool) rotate() error {
+	if ms.writer != nil {
+		if err := ms.writer.Close(); err != nil {
+			ms.agent.error(err)
+		}
+		ms.writer = nil
+	}
+
+	seq := ms.cursor.Segment
+	if last := ms.lastSegment(); last != nil {
+		seq = last.seq + 1
+	}
+
+	f, err := os.OpenFile(ms.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	ms.writer = f
+	ms.segments = append(ms.segments, &spoolSegment{seq: seq, size: 0})
+
+	return nil
+}
+
+// enforceMaxSize removes the oldest segments while the spool is larger than
+// SpoolMaxSize. The last segment is kept.
+func (ms *MessageSpool) enforceMaxSize() error {
+	if ms.agent.SpoolMaxSize <= 0 {
+		return nil
+	}
+
+	for len(ms.segments) > 1 && ms.size() > ms.agent.SpoolMaxSize {
+		oldest := ms.segments[0]
+
+		offset := int64(0)
+		if oldest.seq == ms.cursor.Segment {
+			offset = ms.cursor.Offset
+		}
+
+		n, err := ms.countLines(oldest, offset)
+		if err != nil {
+			return err
+		}
+
+		if err := ms.removeSegment(oldest); err != nil {
+			return err
+		}
+
+		if ms.cursor.Segment <= oldest.seq {
+			ms.cursor = spoolCursor{Segment: ms.segments[0].seq, Offset: 0}
+			if err := ms.saveCursor(); err != nil {
+				return err
+			}
+		}
+
+		ms.pending -= n
+		ms.dropped += n
+		ms.agent.warn("Spool exceeds %v bytes, dropped %v messages", ms.agent.SpoolMaxSize, n)
+	}
+
+	return nil
+}
+
+// read returns a batch of up to max messages after the cursor.
+func (ms *MessageSpool) read(max int) (*spoolBatch, error) {
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	if err := ms.open(); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0)
+	cursor := ms.cursor
+	var invalid int64
+	segments := make([]spoolBatchSegment, 0)
+
+	for i, s := range ms.segments {
+		if s.seq < cursor.Segment {
+			continue
+		}
+
+		read := spoolBatchSegment{seq: s.seq}
+
+		f, err := os.Open(ms.segmentPath(s.seq))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := f.Seek(cursor.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// Lines are written in one call under spoolLock, so a line without
+		// newline is left over from a crash.
+		r := bufio.NewReader(f)
+		for len(messages) < max {
+			line, err := r.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				f.Close()
+				return nil, err
+			}
+
+			cursor.Offset += int64(len(line))
+
+			var m Message
+			if len(line) > 0 {
+				if jerr := json.Unmarshal(line, &m); jerr != nil || m.Version != WireVersion {
+					invalid++
+					read.invalid++
+				} else {
+					messages = append(messages, m)
+					read.messages++
+				}
+			}
+
+			if err == io.EOF {
+				break
+			}
+		}
+		f.Close()
+		segments = append(segments, read)
+
+		if len(messages) >= max || i == len(ms.segments)-1 {
+			break
+		}
+
+		cursor = spoolCursor{Segment: ms.segments[i+1].seq, Offset: 0}
+	}
+
+	batch := &spoolBatch{
+		messages: messages,
+		from:     ms.cursor,
+		to:       cursor,
+		invalid:  invalid,
+		segments: segments,
+	}
+
+	return batch, nil
+}
+
+// commit moves the cursor after an exported batch and removes the exported
+// segments. Segments dropped by enforceMaxSize while the batch was exported
+// moved the cursor to the start of the next segment. Their messages were
+// counted as dropped, but are delivered, and the cursor still moves past
+// the rest of the batch, so no exported message is exported again.
+func (ms *MessageSpool) commit(batch *spoolBatch) error {
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	for _, s := range batch.segments {
+		if s.seq < ms.cursor.Segment {
+			ms.dropped -= s.messages
+			continue
+		}
+
+		ms.pending -= s.messages + s.invalid
+		ms.dropped += s.invalid
+	}
+
+	if !ms.cursor.before(batch.to) {
+		return nil
+	}
+	ms.cursor = batch.to
+
+	for len(ms.segments) > 1 && ms.segments[0].seq < ms.cursor.Segment {
+		if err := ms.removeSegment(ms.segments[0]); err != nil {
+			return err
+		}
+	}
+
+	// The next message starts a new segment after an exported last one.
+	if last := ms.lastSegment(); last != nil && last.seq == ms.cursor.Segment && last.size == ms.cursor.Offset {
+		if err := ms.removeSegment(last); err != nil {
+			return err
+		}
+		ms.cursor = spoolCursor{Segment: last.seq + 1, Offset: 0}
+	}
+
+	return ms.saveCursor()
+}
+
+// sync flushes the last segment to disk.
+func (ms *MessageSpool) sync() error {
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	if ms.writer == nil {
+		return nil
+	}
+
+	return ms.writer.Sync()
+}
+
+// close closes the last segment. The next message starts a new segment.
+func (ms *MessageSpool) close() {
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	if ms.writer == nil {
+		return
+	}
+
+	if err := ms.writer.Close(); err != nil {
+		ms.agent.error(err)
+	}
+	ms.writer = nil
+}
+
+func (ms *MessageSpool) readPending() int64 {
+	if !ms.enabled() {
+		return 0
+	}
+
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	if err := ms.open(); err != nil {
+		ms.agent.error(err)
+	}
+
+	return ms.pending
+}
+
+func (ms *MessageSpool) readDropped() int64 {
+	ms.spoolLock.Lock()
+	defer ms.spoolLock.Unlock()
+
+	return ms.dropped
+}
+
+func (ms *MessageSpool) saveCursor() error {
+	data, err := json.Marshal(ms.cursor)
+	if err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(ms.agent.SpoolDir, spoolCursorFile)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// removeSegment removes s, the oldest segment. If it is also the last one,
+// its writer is closed first.
+func (ms *MessageSpool) removeSegment(s *spoolSegment) error {
+	if len(ms.segments) == 1 && ms.writer != nil {
+		ms.writer.Close()
+		ms.writer = nil
+	}
+
+	if err := os.Remove(ms.segmentPath(s.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	ms.segments = ms.segments[1:]
+
+	return nil
+}
+
+func (ms *MessageSpool) countLines(s *spoolSegment, offset int64) (int64, error) {
+	f, err := os.Open(ms.segmentPath(s.seq))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			n++
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func (ms *MessageSpool) size() int64 {
+	var size int64
+	for _, s := range ms.segments {
+		size += s.size
+	}
+
+	return size
+}
+
+func (ms *MessageSpool) lastSegment() *spoolSegment {
+	if len(ms.segments) == 0 {
+		return nil
+	}
+
+	return ms.segments[len(ms.segments)-1]
+}
+
+func (ms *MessageSpool) segmentPath(seq int64) string {
+	return filepath.Join(ms.agent.SpoolDir, fmt.Sprintf("%020d.log", seq))
+}
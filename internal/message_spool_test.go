@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newSpoolTestAgent(dir string) *Agent {
+	agent := NewAgent()
+	agent.SpoolDir = dir
+
+	return agent
+}
+
+func addSpoolTestMessages(agent *Agent, from int, to int) {
+	for i := from; i < to; i++ {
+		agent.messageQueue.addMessage(testMessage(i))
+	}
+}
+
+func checkSpoolTestMessages(t *testing.T, messages []Message, from int, to int) {
+	if len(messages) != to-from {
+		t.Fatalf("Expected %v messages, but got %v", to-from, len(messages))
+	}
+
+	for i, m := range messages {
+		if m.Topic != TopicMetric || testMessageValue(m) != float64(from+i) {
+			t.Fatalf("Message %v is out of order: %v", i, testMessageValue(m))
+		}
+	}
+}
+
+func TestSpoolFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newSpoolTestAgent(dir)
+	exporter := &testExporter{err: errors.New("unavailable")}
+	agent.Exporter = exporter
+
+	addSpoolTestMessages(agent, 0, 1500)
+
+	if len(agent.messageQueue.queue) != 0 || agent.messageQueue.size() != 1500 {
+		t.Errorf("Messages should be spooled, but queue has %v of %v", len(agent.messageQueue.queue), agent.messageQueue.size())
+	}
+
+	agent.messageQueue.flush()
+
+	if agent.messageQueue.size() != 1500 || agent.messageQueue.backoffDelay == 0 {
+		t.Errorf("Failed export should keep spooled messages with backoff")
+	}
+
+	exporter.err = nil
+	agent.messageQueue.flush()
+
+	checkSpoolTestMessages(t, exporter.messages, 0, 1500)
+
+	if agent.messageQueue.size() != 0 || agent.messageQueue.backoffDelay != 0 {
+		t.Errorf("Spool should be empty, but has %v messages", agent.messageQueue.size())
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) != 0 {
+		t.Errorf("Exported segments should be removed, but got %v", segments)
+	}
+
+	// New messages start a new segment.
+	addSpoolTestMessages(agent, 1500, 1510)
+	agent.messageQueue.flush()
+
+	checkSpoolTestMessages(t, exporter.messages[1500:], 1500, 1510)
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newSpoolTestAgent(dir)
+	agent.SpoolMaxSize = 4096 * spoolSegments
+	exporter := &testExporter{}
+	agent.Exporter = exporter
+
+	addSpoolTestMessages(agent, 0, 10)
+	agent.messageQueue.flush()
+	addSpoolTestMessages(agent, 10, 100)
+	agent.messageSpool.close()
+
+	// A crash may leave a partial line.
+	segment := agent.messageSpool.lastSegment()
+	f, err := os.OpenFile(agent.messageSpool.segmentPath(segment.seq), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"topic":"te`)
+	f.Close()
+
+	restarted := newSpoolTestAgent(dir)
+	restarted.SpoolMaxSize = agent.SpoolMaxSize
+	restartedExporter := &testExporter{}
+	restarted.Exporter = restartedExporter
+
+	if restarted.messageQueue.size() != 91 {
+		t.Errorf("Expected 91 messages to replay, but got %v", restarted.messageQueue.size())
+	}
+
+	addSpoolTestMessages(restarted, 100, 110)
+	restarted.messageQueue.flush()
+
+	checkSpoolTestMessages(t, exporter.messages, 0, 10)
+	checkSpoolTestMessages(t, restartedExporter.messages, 10, 110)
+
+	if restarted.messageQueue.size() != 0 || restarted.messageSpool.readDropped() != 1 {
+		t.Errorf("Partial line should be dropped, but %v messages are left and %v dropped", restarted.messageQueue.size(), restarted.messageSpool.readDropped())
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newSpoolTestAgent(dir)
+	agent.SpoolMaxSize = 1000 * spoolSegments
+	exporter := &testExporter{}
+	agent.Exporter = exporter
+
+	addSpoolTestMessages(agent, 0, 1000)
+
+	dropped := agent.messageSpool.readDropped()
+	if dropped == 0 || agent.messageSpool.size() > agent.SpoolMaxSize {
+		t.Fatalf("Spool should be limited to %v bytes, but has %v bytes and dropped %v messages", agent.SpoolMaxSize, agent.messageSpool.size(), dropped)
+	}
+
+	if int64(agent.messageQueue.size())+dropped != 1000 {
+		t.Errorf("Spooled and dropped messages should add up, but are %v and %v", agent.messageQueue.size(), dropped)
+	}
+
+	agent.messageQueue.flush()
+
+	// The newest messages are kept.
+	checkSpoolTestMessages(t, exporter.messages, int(dropped), 1000)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) != 0 {
+		t.Errorf("Exported segments should be removed, but got %v", segments)
+	}
+}
+
+func TestSpoolMaxSizeDuringExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// segments of about 10 messages
+	agent := newSpoolTestAgent(dir)
+	agent.SpoolMaxSize = int64(len(wireJSON(t, testMessage(50)))+1) * 10 * spoolSegments
+	exporter := &testExporter{started: make(chan bool, 100), wait: make(chan bool)}
+	agent.Exporter = exporter
+
+	addSpoolTestMessages(agent, 0, 40)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		agent.messageQueue.flush()
+	}()
+
+	// The oldest segment is dropped while its messages are exported.
+	<-exporter.started
+	addSpoolTestMessages(agent, 40, 90)
+	dropped := agent.messageSpool.readDropped()
+	if dropped == 0 {
+		t.Fatalf("Spool should drop messages beyond %v bytes", agent.SpoolMaxSize)
+	}
+
+	close(exporter.wait)
+	<-done
+	agent.messageQueue.flush()
+
+	// Exported messages are not exported again.
+	for i, m := range exporter.messages {
+		if i > 0 && testMessageValue(m) <= testMessageValue(exporter.messages[i-1]) {
+			t.Fatalf("Message %v was exported again after %v", testMessageValue(m), testMessageValue(exporter.messages[i-1]))
+		}
+	}
+
+	if int64(len(exporter.messages))+agent.messageSpool.readDropped() != 90 || agent.messageQueue.size() != 0 {
+		t.Errorf("Exported and dropped messages should add up, but are %v and %v", len(exporter.messages), agent.messageSpool.readDropped())
+	}
+}
+
+func TestSpoolUnlimited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newSpoolTestAgent(dir)
+	agent.SpoolMaxSize = 0
+
+	addSpoolTestMessages(agent, 0, 100)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) != 1 || agent.messageSpool.readDropped() != 0 {
+		t.Errorf("Unlimited spool should keep all messages in one segment, but has %v segments", len(segments))
+	}
+}
@@ -1,7 +1,6 @@
 package internal
 
 import (
-	"fmt"
 	"math"
 	"sync/atomic"
 	"time"
@@ -53,6 +52,9 @@ const CategorySegmentTrace string = "segment-trace"
 //CategoryErrorProfile ...
 const CategoryErrorProfile string = "error-profile"
 
+//CategoryAgent ...
+const CategoryAgent string = "agent"
+
 //NameCPUTime ...
 const NameCPUTime string = "CPU time"
 
@@ -108,6 +110,13 @@ const NameGCCPUFraction string = "GC CPU fraction"
 const NameHeapAllocation string = "Heap allocation"
 const NameBlockingCallTimes string = "Blocking call times"
 const NameHTTPTransactionBreakdown string = "HTTP transaction breakdown"
+const NameProfileParsing string = "Profile parsing"
+const NameProfileParseAllocations string = "Profile parsing allocations"
+const NameMessageQueueSize string = "Message queue size"
+const NameExportFailures string = "Export failures"
+const NameQueueDroppedMessages string = "Message queue dropped messages"
+const NameQueueRetriedMessages string = "Message queue retried messages"
+const NameSpoolDroppedMessages string = "Spool dropped messages"
 
 const UnitNone string = ""
 const UnitMillisecond string = "millisecond"
@@ -170,6 +179,12 @@ func (m *Metric) hasMeasurement() bool {
 }
 
 func (m *Metric) createMeasurement(trigger string, value float64, duration int64, breakdown *BreakdownNode) {
+	m.createMeasurementWithID(m.agent.uuid(), trigger, value, duration, breakdown)
+}
+
+// createMeasurementWithID creates a measurement with an ID generated before
+// the report, e.g. one already attached to exemplars during the interval.
+func (m *Metric) createMeasurementWithID(id string, trigger string, value float64, duration int64, breakdown *BreakdownNode) {
 	ready := true
 
 	if m.typ == TypeCounter {
@@ -186,7 +201,7 @@ func (m *Metric) createMeasurement(trigger string, value float64, duration int64
 
 	if ready {
 		m.measurement = &Measurement{
-			id:        m.agent.uuid(),
+			id:        id,
 			trigger:   trigger,
 			value:     value,
 			duration:  duration,
@@ -196,51 +211,6 @@ func (m *Metric) createMeasurement(trigger string, value float64, duration int64
 	}
 }
 
-func (m *Metric) toStringArray() []string {
-	sArray := make([]string, 0)
-	sArray = append(
-		sArray,
-		// m.typ,
-		// m.name,
-		fmt.Sprintf("%v%v", m.measurement.value, m.unit),
-		fmt.Sprint(m.measurement.duration),
-		fmt.Sprint(m.measurement.timestamp),
-		fmt.Sprint(m.measurement.breakdown),
-	)
-	return sArray
-}
-
-//TODO: REFACTOR - @Darshan
-func (m *Metric) toMap() map[string]interface{} {
-	var measurementMap map[string]interface{}
-	if m.measurement != nil {
-		var breakdownMap map[string]interface{}
-		if m.measurement.breakdown != nil {
-			breakdownMap = m.measurement.breakdown.toMap()
-		}
-
-		measurementMap = map[string]interface{}{
-			"id":        m.measurement.id,
-			"trigger":   m.measurement.trigger,
-			"value":     m.measurement.value,
-			"duration":  m.measurement.duration,
-			"breakdown": breakdownMap,
-			"timestamp": m.measurement.timestamp,
-		}
-	}
-
-	metricMap := map[string]interface{}{
-		"id":          m.id,
-		"type":        m.typ,
-		"category":    m.category,
-		"name":        m.name,
-		"unit":        m.unit,
-		"measurement": measurementMap,
-	}
-
-	return metricMap
-}
-
 //AddFloat64 ....
 func AddFloat64(addr *float64, val float64) (new float64) {
 	for {
@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//MetricNamespace - Prefix of all metric families exposed by MetricCollector.
+const MetricNamespace string = "profileagent"
+
+//ExemplarLabel is the exemplar label holding the ID of a profile measurement.
+const ExemplarLabel string = "measurement_id"
+
+//SegmentPathSeparator joins the names of nested segments in the segment label.
+const SegmentPathSeparator string = " > "
+
+//MetricCollector exposes the last measurement of every reported Metric as a
+// Prometheus gauge or counter. Metrics of one type, category and unit share
+// a family, e.g. profileagent_memory_bytes{name="Current RSS"}. Values are
+// converted to base units, seconds, bytes and ratios.
+//
+// Hot functions of the CPU, block and heap profiles are exposed per profiler,
+// e.g. profileagent_cpu_function_ratio{function="main.work",scope="self"}.
+// Segment durations are observed into profileagent_segment_duration_seconds
+// histograms and errors are counted in profileagent_errors_total as they are
+// recorded.
+//
+// Reported profiles are counted in profileagent_profiles_total{category}.
+// Profile counters, segment histograms and error counters carry the
+// measurement ID of the counted profile, segment or error as exemplar, which
+// is exposed when scraped in the OpenMetrics format.
+//
+// The set of families depends on what reporters produce, so the collector
+// is unchecked and describes no metrics upfront.
+type MetricCollector struct {
+	agent            *Agent
+	samples          map[string]*metricSample
+	functions        map[string][]*metricSample
+	descs            map[string]*prometheus.Desc
+	segmentDurations *prometheus.HistogramVec
+	errors           *prometheus.CounterVec
+	errorClasses     map[string]map[string]bool
+	profiles         *prometheus.CounterVec
+	samplesLock      *sync.Mutex
+	registerer       prometheus.Registerer
+}
+
+type metricSample struct {
+	desc        *prometheus.Desc
+	valueType   prometheus.ValueType
+	labelValues []string
+	value       float64
+}
+
+func newMetricCollector(agent *Agent) *MetricCollector {
+	mc := &MetricCollector{
+		agent:            agent,
+		samples:          make(map[string]*metricSample),
+		functions:        make(map[string][]*metricSample),
+		descs:            make(map[string]*prometheus.Desc),
+		segmentDurations: nil,
+		errors:           nil,
+		errorClasses:     make(map[string]map[string]bool),
+		profiles:         nil,
+		samplesLock:      &sync.Mutex{},
+		registerer:       nil,
+	}
+
+	return mc
+}
+
+// start creates the segment and error vectors and registers the collector
+// with the agent's Registerer, if any. Both happen once. The collector stays
+// registered after Stop, so the final reports remain visible.
+func (mc *MetricCollector) start() {
+	mc.samplesLock.Lock()
+	if mc.segmentDurations == nil {
+		mc.segmentDurations = newSegmentDurations(mc.agent)
+		mc.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   MetricNamespace,
+			Name:        "errors_total",
+			Help:        "Recorded errors and panics by group and normalized message class.",
+			ConstLabels: prometheus.Labels{"app_name": mc.agent.AppName},
+		}, []string{"group", "class"})
+		mc.profiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   MetricNamespace,
+			Name:        "profiles_total",
+			Help:        "Reported profiles by category.",
+			ConstLabels: prometheus.Labels{"app_name": mc.agent.AppName},
+		}, []string{"category"})
+	}
+	mc.samplesLock.Unlock()
+
+	if mc.agent.Registerer == nil || mc.registerer != nil {
+		return
+	}
+
+	if err := mc.agent.Registerer.Register(mc); err != nil {
+		mc.agent.error(err)
+		return
+	}
+
+	mc.registerer = mc.agent.Registerer
+}
+
+func newSegmentDurations(agent *Agent) *prometheus.HistogramVec {
+	buckets := agent.SegmentBuckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+
+	opts := prometheus.HistogramOpts{
+		Namespace:   MetricNamespace,
+		Subsystem:   "segment",
+		Name:        "duration_seconds",
+		Help:        "Duration of measured segments. Nested segments are labeled with their path.",
+		ConstLabels: prometheus.Labels{"app_name": agent.AppName},
+		Buckets:     buckets,
+	}
+	if agent.SegmentNativeHistogramFactor > 1 {
+		opts.NativeHistogramBucketFactor = agent.SegmentNativeHistogramFactor
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+
+	return prometheus.NewHistogramVec(opts, []string{"segment"})
+}
+
+// observeSegment observes a segment duration in milliseconds. Nested
+// segments are labeled with the names of their path joined by " > ".
+func (mc *MetricCollector) observeSegment(path []string, duration float64, measurementID string) {
+	mc.samplesLock.Lock()
+	segmentDurations := mc.segmentDurations
+	mc.samplesLock.Unlock()
+
+	if segmentDurations == nil {
+		return
+	}
+
+	observer := segmentDurations.WithLabelValues(strings.Join(path, SegmentPathSeparator))
+	if measurementID == "" {
+		observer.Observe(duration / 1e3)
+		return
+	}
+
+	observer.(prometheus.ExemplarObserver).ObserveWithExemplar(duration/1e3, prometheus.Labels{ExemplarLabel: measurementID})
+}
+
+func (mc *MetricCollector) update(m *Metric) {
+	if m.measurement == nil {
+		return
+	}
+
+	familyName, valueType, factor := metricFamily(m.typ, m.category, m.unit)
+	value := m.measurement.value * factor
+
+	mc.samplesLock.Lock()
+	defer mc.samplesLock.Unlock()
+
+	// Measurements with a breakdown are profiles.
+	if m.measurement.breakdown != nil && mc.profiles != nil {
+		exemplarLabels := prometheus.Labels{ExemplarLabel: m.measurement.id}
+		mc.profiles.WithLabelValues(m.category).(prometheus.ExemplarAdder).AddWithExemplar(1, exemplarLabels)
+	}
+
+	s, exists := mc.samples[m.id]
+	if !exists {
+		desc := mc.desc(familyName, "Profile agent "+m.category+" metrics, see the name label.", "name")
+
+		s = &metricSample{
+			desc:        desc,
+			valueType:   valueType,
+			labelValues: []string{m.name},
+			value:       0,
+		}
+		mc.samples[m.id] = s
+	}
+
+	// Counter measurements are deltas since the previous report.
+	if valueType == prometheus.CounterValue {
+		s.value += value
+	} else {
+		s.value = value
+	}
+}
+
+// updateFunctions replaces the hot function series of a profiler, so
+// functions that dropped out of the top N are no longer exposed. Empty
+// values remove all series of the profiler.
+func (mc *MetricCollector) updateFunctions(profiler string, unit string, self []FunctionValue, cumulative []FunctionValue) {
+	baseUnit, factor := baseUnit(unit)
+
+	familyName := MetricNamespace + "_" + profiler + "_function"
+	if baseUnit != "" {
+		familyName += "_" + baseUnit
+	}
+
+	mc.samplesLock.Lock()
+	defer mc.samplesLock.Unlock()
+
+	if len(self) == 0 && len(cumulative) == 0 {
+		delete(mc.functions, profiler)
+		return
+	}
+
+	desc := mc.desc(familyName, "Hottest functions of the last "+profiler+" profile, self or cumulative.", "function", "scope")
+
+	samples := make([]*metricSample, 0, len(self)+len(cumulative))
+	for _, fv := range self {
+		samples = append(samples, &metricSample{
+			desc:        desc,
+			valueType:   prometheus.GaugeValue,
+			labelValues: []string{fv.function, "self"},
+			value:       fv.value * factor,
+		})
+	}
+	for _, fv := range cumulative {
+		samples = append(samples, &metricSample{
+			desc:        desc,
+			valueType:   prometheus.GaugeValue,
+			labelValues: []string{fv.function, "cumulative"},
+			value:       fv.value * factor,
+		})
+	}
+
+	mc.functions[profiler] = samples
+}
+
+// desc returns the cached descriptor of a family. It must be called with
+// samplesLock held.
+func (mc *MetricCollector) desc(familyName string, help string, labels ...string) *prometheus.Desc {
+	desc, exists := mc.descs[familyName]
+	if !exists {
+		desc = prometheus.NewDesc(
+			familyName,
+			help,
+			labels,
+			prometheus.Labels{"app_name": mc.agent.AppName})
+		mc.descs[familyName] = desc
+	}
+
+	return desc
+}
+
+// incrementError counts an error of a group and returns its class. At most
+// MaxErrorClasses classes are exposed per group, further classes are
+// counted as "Other".
+func (mc *MetricCollector) incrementError(group string, err error, measurementID string) string {
+	class := errorClass(err)
+
+	mc.samplesLock.Lock()
+	errors := mc.errors
+	if errors != nil {
+		classes, exists := mc.errorClasses[group]
+		if !exists {
+			classes = make(map[string]bool)
+			mc.errorClasses[group] = classes
+		}
+
+		if !classes[class] {
+			if len(classes) < MaxErrorClasses {
+				classes[class] = true
+			} else {
+				class = "Other"
+			}
+		}
+	}
+	mc.samplesLock.Unlock()
+
+	if errors == nil {
+		return class
+	}
+
+	counter := errors.WithLabelValues(group, class)
+	if measurementID == "" {
+		counter.Inc()
+		return class
+	}
+
+	counter.(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{ExemplarLabel: measurementID})
+	return class
+}
+
+//Describe implements prometheus.Collector. It sends no descriptors, which
+// makes the collector unchecked.
+func (mc *MetricCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+//Collect implements prometheus.Collector.
+func (mc *MetricCollector) Collect(ch chan<- prometheus.Metric) {
+	mc.samplesLock.Lock()
+	defer mc.samplesLock.Unlock()
+
+	for _, s := range mc.samples {
+		ch <- prometheus.MustNewConstMetric(s.desc, s.valueType, s.value, s.labelValues...)
+	}
+
+	for _, samples := range mc.functions {
+		for _, s := range samples {
+			ch <- prometheus.MustNewConstMetric(s.desc, s.valueType, s.value, s.labelValues...)
+		}
+	}
+
+	if mc.segmentDurations != nil {
+		mc.segmentDurations.Collect(ch)
+	}
+
+	if mc.errors != nil {
+		mc.errors.Collect(ch)
+		mc.profiles.Collect(ch)
+	}
+}
+
+// metricFamily returns the family name, value type and the factor converting
+// values to the family's base unit.
+func metricFamily(typ string, category string, unit string) (string, prometheus.ValueType, float64) {
+	baseUnit, factor := baseUnit(unit)
+
+	name := MetricNamespace + "_" + strings.Replace(category, "-", "_", -1)
+	if baseUnit != "" {
+		name += "_" + baseUnit
+	}
+
+	if typ == TypeCounter {
+		return name + "_total", prometheus.CounterValue, factor
+	}
+
+	return name, prometheus.GaugeValue, factor
+}
+
+func baseUnit(unit string) (string, float64) {
+	switch unit {
+	case UnitMillisecond:
+		return "seconds", 1e-3
+	case UnitMicrosecond:
+		return "seconds", 1e-6
+	case UnitNanosecond:
+		return "seconds", 1e-9
+	case UnitByte:
+		return "bytes", 1
+	case UnitKilobyte:
+		return "bytes", 1024
+	case UnitPercent:
+		return "ratio", 1e-2
+	}
+
+	return "", 1
+}
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gatherFamilies(t *testing.T, registry *prometheus.Registry) map[string]*dto.MetricFamily {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]*dto.MetricFamily)
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+
+	return byName
+}
+
+func TestMetricCollector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.Registerer = registry
+	agent.metricCollector.start()
+
+	rss := newMetric(agent, TypeState, CategoryMemory, NameCurrentRSS, UnitKilobyte)
+	rss.createMeasurement(TriggerTimer, 2, 0, nil)
+	agent.publishMetric(rss)
+
+	mallocs := newMetric(agent, TypeCounter, CategoryMemory, NameMallocs, UnitNone)
+	for _, v := range []float64{100, 150, 170} {
+		mallocs.createMeasurement(TriggerTimer, v, 0, nil)
+		agent.publishMetric(mallocs)
+	}
+
+	cpu := newMetric(agent, TypeProfile, CategoryCPUProfile, NameCPUUsage, UnitPercent)
+	cpu.createMeasurement(TriggerTimer, 25, 0, nil)
+	agent.publishMetric(cpu)
+
+	families := gatherFamilies(t, registry)
+
+	f := families["profileagent_memory_bytes"]
+	if f == nil || f.GetType() != dto.MetricType_GAUGE || f.Metric[0].GetGauge().GetValue() != 2048 {
+		t.Errorf("Invalid RSS family: %v", f)
+	}
+
+	f = families["profileagent_memory_total"]
+	if f == nil || f.GetType() != dto.MetricType_COUNTER || f.Metric[0].GetCounter().GetValue() != 70 {
+		t.Errorf("Invalid mallocs family: %v", f)
+	}
+
+	f = families["profileagent_cpu_profile_ratio"]
+	if f == nil || math.Abs(f.Metric[0].GetGauge().GetValue()-0.25) > 1e-9 {
+		t.Errorf("Invalid CPU profile family: %v", f)
+	}
+
+	labels := make(map[string]string)
+	for _, l := range f.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["app_name"] != "App1" || labels["name"] != NameCPUUsage || len(labels) != 2 {
+		t.Errorf("Invalid labels: %v", labels)
+	}
+}
+
+func TestMetricCollectorRegisterOnce(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.Registerer = registry
+
+	agent.metricCollector.start()
+	agent.metricCollector.start()
+
+	metric := newMetric(agent, TypeState, CategoryRuntime, NameNumGoroutines, UnitNone)
+	metric.createMeasurement(TriggerTimer, 10, 0, nil)
+	agent.publishMetric(metric)
+
+	// A second registration of the unchecked collector would duplicate the
+	// series and fail the gather.
+	if f := gatherFamilies(t, registry)["profileagent_runtime"]; f == nil || len(f.Metric) != 1 {
+		t.Errorf("Invalid runtime family: %v", f)
+	}
+}
+
+func TestMetricCollectorFunctions(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.Registerer = registry
+	agent.metricCollector.start()
+
+	agent.metricCollector.updateFunctions(ProfilerCPU, UnitPercent,
+		[]FunctionValue{{function: "main.a", value: 50}, {function: "main.b", value: 20}},
+		[]FunctionValue{{function: "main.main", value: 100}})
+
+	f := gatherFamilies(t, registry)["profileagent_cpu_function_ratio"]
+	if f == nil || len(f.Metric) != 3 {
+		t.Fatalf("Invalid function family: %v", f)
+	}
+
+	agent.metricCollector.updateFunctions(ProfilerCPU, UnitPercent,
+		[]FunctionValue{{function: "main.c", value: 40}}, nil)
+
+	f = gatherFamilies(t, registry)["profileagent_cpu_function_ratio"]
+	if f == nil || len(f.Metric) != 1 {
+		t.Fatalf("Functions out of the top should be removed: %v", f)
+	}
+
+	labels := make(map[string]string)
+	for _, l := range f.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["function"] != "main.c" || labels["scope"] != "self" || f.Metric[0].GetGauge().GetValue() != 0.4 {
+		t.Errorf("Invalid function series: %v", f.Metric[0])
+	}
+
+	agent.metricCollector.updateFunctions(ProfilerCPU, UnitPercent, nil, nil)
+
+	if f := gatherFamilies(t, registry)["profileagent_cpu_function_ratio"]; f != nil {
+		t.Errorf("Functions should be removed: %v", f)
+	}
+}
+
+func TestMetricCollectorSegments(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.Registerer = registry
+	agent.SegmentBuckets = []float64{0.1, 1}
+	agent.SegmentNativeHistogramFactor = 1.1
+	agent.metricCollector.start()
+
+	agent.segmentReporter.recordSegmentPath([]string{"Handler /test"}, 50)
+	agent.segmentReporter.recordSegmentPath([]string{"Handler /test"}, 500)
+	agent.segmentReporter.recordSegmentPath([]string{"Handler /test", "db"}, 20)
+
+	f := gatherFamilies(t, registry)["profileagent_segment_duration_seconds"]
+	if f == nil || f.GetType() != dto.MetricType_HISTOGRAM || len(f.Metric) != 2 {
+		t.Fatalf("Invalid segment family: %v", f)
+	}
+
+	for _, m := range f.Metric {
+		labels := make(map[string]string)
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+
+		h := m.GetHistogram()
+		switch labels["segment"] {
+		case "Handler /test":
+			if h.GetSampleCount() != 2 || len(h.Bucket) != 2 || h.Bucket[0].GetCumulativeCount() != 1 {
+				t.Errorf("Invalid handler histogram: %v", h)
+			}
+			if h.GetSchema() == 0 && len(h.PositiveSpan) == 0 {
+				t.Errorf("Handler histogram should have native buckets: %v", h)
+			}
+		case "Handler /test > db":
+			if h.GetSampleCount() != 1 || math.Abs(h.GetSampleSum()-0.02) > 1e-9 {
+				t.Errorf("Invalid nested histogram: %v", h)
+			}
+		default:
+			t.Errorf("Unexpected segment label: %v", labels)
+		}
+	}
+}
+
+func TestMetricCollectorErrors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.Registerer = registry
+	agent.metricCollector.start()
+
+	agent.errorReporter.recordError("Recovered panics", fmt.Errorf("index out of range [%v]", 5), 0)
+	agent.errorReporter.recordError("Recovered panics", fmt.Errorf("index out of range [%v]", 7), 0)
+	for i := 0; i < MaxErrorClasses+5; i++ {
+		agent.errorReporter.recordError("Handled exceptions", fmt.Errorf("error %v", strings.Repeat("x", i)), 0)
+	}
+
+	f := gatherFamilies(t, registry)["profileagent_errors_total"]
+	if f == nil || f.GetType() != dto.MetricType_COUNTER {
+		t.Fatalf("Invalid errors family: %v", f)
+	}
+
+	counts := make(map[string]float64)
+	handledClasses := 0
+	for _, m := range f.Metric {
+		labels := make(map[string]string)
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		counts[labels["group"]+"/"+labels["class"]] = m.GetCounter().GetValue()
+		if labels["group"] == "Handled exceptions" {
+			handledClasses++
+		}
+	}
+
+	if counts["Recovered panics/index out of range [<n>]"] != 2 {
+		t.Errorf("Panics should be counted in one class: %v", counts)
+	}
+
+	if handledClasses != MaxErrorClasses+1 || counts["Handled exceptions/Other"] != 5 {
+		t.Errorf("Error classes should be bounded: %v", counts)
+	}
+}
+
+func TestMetricCollectorExemplars(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.Registerer = registry
+	agent.metricCollector.start()
+
+	profile := newBreakdownNode("root")
+	profile.measurement = 10
+	cpuProfile := newMetric(agent, TypeProfile, CategoryCPUProfile, NameCPUUsage, UnitPercent)
+	cpuProfile.createMeasurement(TriggerTimer, profile.measurement, 0, profile)
+	agent.publishMetric(cpuProfile)
+
+	cpuTime := newMetric(agent, TypeCounter, CategoryCPU, NameCPUTime, UnitNanosecond)
+	cpuTime.createMeasurement(TriggerTimer, 1e9, 0, nil)
+	cpuTime.createMeasurement(TriggerTimer, 2e9, 0, nil)
+	agent.publishMetric(cpuTime)
+
+	agent.segmentReporter.recordSegmentPath([]string{"segment1"}, 10)
+	segmentID := agent.segmentReporter.segmentIDs["segment1"]
+
+	families := gatherFamilies(t, registry)
+
+	exemplarID := func(e *dto.Exemplar) string {
+		for _, l := range e.GetLabel() {
+			if l.GetName() == ExemplarLabel {
+				return l.GetValue()
+			}
+		}
+		return ""
+	}
+
+	f := families["profileagent_profiles_total"]
+	if f == nil || exemplarID(f.Metric[0].GetCounter().GetExemplar()) != cpuProfile.measurement.id {
+		t.Errorf("Profile counter should have the profile exemplar: %v", f)
+	}
+
+	// the profile's ID is no exemplar of CPU time that was not profiled
+	f = families["profileagent_cpu_seconds_total"]
+	if f == nil || f.Metric[0].GetCounter().GetExemplar() != nil {
+		t.Errorf("CPU time counter should have no exemplar: %v", f)
+	}
+
+	f = families["profileagent_segment_duration_seconds"]
+	found := false
+	for _, b := range f.Metric[0].GetHistogram().GetBucket() {
+		if b.GetExemplar() != nil && exemplarID(b.GetExemplar()) == segmentID {
+			found = true
+		}
+	}
+	if segmentID == "" || !found {
+		t.Errorf("Segment histogram should have the segment exemplar: %v", f)
+	}
+
+	agent.segmentReporter.report()
+	if len(agent.segmentReporter.segmentIDs) != 0 {
+		t.Error("Segment IDs should be reset on report")
+	}
+
+	queue := agent.messageQueue.queue
+	measurement := queue[len(queue)-1].Metric.Measurement
+	if measurement.ID != segmentID {
+		t.Errorf("Segment measurement ID should be %v, but is %v", segmentID, measurement.ID)
+	}
+}
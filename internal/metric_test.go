@@ -126,6 +126,38 @@ func TestBreakdownP95Big(t *testing.T) {
 	}
 }
 
+func TestBreakdownTopFunctions(t *testing.T) {
+	root := newBreakdownNode("root")
+	root.measurement = 10
+
+	main := newBreakdownNode("main.main (main.go:10)")
+	main.measurement = 10
+	root.addChild(main)
+
+	work := newBreakdownNode("main.work (main.go:20)")
+	work.measurement = 8
+	main.addChild(work)
+
+	// recursive call of the same function on another line
+	workRecursive := newBreakdownNode("main.work (main.go:25)")
+	workRecursive.measurement = 6
+	work.addChild(workRecursive)
+
+	hash := newBreakdownNode("crypto/sha1.block (sha1block.go:5)")
+	hash.measurement = 1
+	workRecursive.addChild(hash)
+
+	self, cumulative := root.topFunctions(2)
+
+	if len(self) != 2 || self[0].function != "main.work" || self[0].value != 7 || self[1].function != "main.main" || self[1].value != 2 {
+		t.Errorf("Invalid self values: %v", self)
+	}
+
+	if len(cumulative) != 2 || cumulative[0].function != "main.main" || cumulative[0].value != 10 || cumulative[1].function != "main.work" || cumulative[1].value != 8 {
+		t.Errorf("Invalid cumulative values: %v", cumulative)
+	}
+}
+
 func TestAddFloat64(t *testing.T) {
 	f := float64(10.3)
 	AddFloat64(&f, float64(5.2))
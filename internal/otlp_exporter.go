@@ -0,0 +1,421 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+//OTLPProtocolProtobuf - OTLP over HTTP with protobuf encoded requests.
+const OTLPProtocolProtobuf string = "http/protobuf"
+
+//OTLPProtocolJSON - OTLP over HTTP with JSON encoded requests.
+const OTLPProtocolJSON string = "http/json"
+
+//OTLPExporter sends the agent's metrics as OTLP to
+// <OTLPAddress>/v1/metrics, e.g. of an OpenTelemetry collector. It is fed by
+// the reporters like MetricCollector, independently of the message queue
+// and Exporter.
+//
+// State and profile metrics become gauges and counters become cumulative
+// monotonic sums. Names and base units are those of MetricCollector's
+// families, the metric name is the "name" attribute. Segment duration
+// reservoirs become cumulative histograms, profileagent_segment_duration_seconds
+// with a "segment" attribute and SegmentBuckets as bounds. Reservoirs hold at
+// most ReservoirSize samples per interval, larger intervals are scaled to the
+// number of recorded segments.
+//
+// The resource carries service.name, service.version,
+// deployment.environment.name, host.name and the run ID as
+// service.instance.id. Metrics are sent after every process report and on Stop.
+type OTLPExporter struct {
+	agent      *Agent
+	points     map[string]*otlpPoint
+	histograms map[string]*otlpHistogram
+	pointsLock *sync.Mutex
+	exportLock *sync.Mutex
+}
+
+type otlpPoint struct {
+	familyName string
+	unit       string
+	name       string
+	monotonic  bool
+	value      float64
+	timestamp  int64
+}
+
+type otlpHistogram struct {
+	segment      string
+	bounds       []float64
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+	timestamp    int64
+}
+
+func newOTLPExporter(agent *Agent) *OTLPExporter {
+	oe := &OTLPExporter{
+		agent:      agent,
+		points:     make(map[string]*otlpPoint),
+		histograms: make(map[string]*otlpHistogram),
+		pointsLock: &sync.Mutex{},
+		exportLock: &sync.Mutex{},
+	}
+
+	return oe
+}
+
+// update records the last measurement of a metric. Segment traces are
+// exported as histograms from their reservoirs instead.
+func (oe *OTLPExporter) update(m *Metric) {
+	if oe.agent.OTLPAddress == "" || m.measurement == nil || m.typ == TypeTrace {
+		return
+	}
+
+	familyName, valueType, factor := metricFamily(m.typ, m.category, m.unit)
+	baseUnit, _ := baseUnit(m.unit)
+
+	oe.pointsLock.Lock()
+	defer oe.pointsLock.Unlock()
+
+	p, exists := oe.points[m.id]
+	if !exists {
+		p = &otlpPoint{
+			familyName: familyName,
+			unit:       otlpUnit(baseUnit),
+			name:       m.name,
+			monotonic:  valueType == prometheus.CounterValue,
+			value:      0,
+			timestamp:  0,
+		}
+		oe.points[m.id] = p
+	}
+
+	// Counter measurements are deltas since the previous report.
+	if p.monotonic {
+		p.value += m.measurement.value * factor
+	} else {
+		p.value = m.measurement.value * factor
+	}
+	p.timestamp = m.measurement.timestamp
+}
+
+// observeReservoirs adds the reservoirs of a segment node and its nested
+// segments to the segment histograms. It must be called before
+// evaluateP95, which resets the reservoirs.
+func (oe *OTLPExporter) observeReservoirs(path []string, node *BreakdownNode) {
+	if oe.agent.OTLPAddress == "" {
+		return
+	}
+
+	path = append(path[:len(path):len(path)], node.name)
+
+	node.updateLock.RLock()
+	reservoir := make([]float64, len(node.reservoir))
+	copy(reservoir, node.reservoir)
+	children := make([]*BreakdownNode, 0, len(node.children))
+	for _, child := range node.children {
+		children = append(children, child)
+	}
+	node.updateLock.RUnlock()
+
+	oe.observeReservoir(strings.Join(path, SegmentPathSeparator), reservoir, node.numSamples)
+
+	for _, child := range children {
+		oe.observeReservoirs(path, child)
+	}
+}
+
+// observeReservoir adds reservoir durations in milliseconds to the histogram
+// of a segment. If more segments were recorded than sampled, bucket counts
+// and sum are scaled by numSamples / len(reservoir).
+func (oe *OTLPExporter) observeReservoir(segment string, reservoir []float64, numSamples int64) {
+	if len(reservoir) == 0 {
+		return
+	}
+
+	scale := 1.0
+	if numSamples > int64(len(reservoir)) {
+		scale = float64(numSamples) / float64(len(reservoir))
+	}
+
+	oe.pointsLock.Lock()
+	defer oe.pointsLock.Unlock()
+
+	h, exists := oe.histograms[segment]
+	if !exists {
+		bounds := oe.agent.SegmentBuckets
+		if len(bounds) == 0 {
+			bounds = prometheus.DefBuckets
+		}
+
+		h = &otlpHistogram{
+			segment:      segment,
+			bounds:       bounds,
+			bucketCounts: make([]uint64, len(bounds)+1),
+			count:        0,
+			sum:          0,
+			timestamp:    0,
+		}
+		oe.histograms[segment] = h
+	}
+
+	sampledCounts := make([]float64, len(h.bounds)+1)
+	sampledSum := 0.0
+	for _, duration := range reservoir {
+		seconds := duration / 1e3
+		sampledCounts[sort.SearchFloat64s(h.bounds, seconds)]++
+		sampledSum += seconds
+	}
+
+	for i, c := range sampledCounts {
+		n := uint64(math.Round(c * scale))
+		h.bucketCounts[i] += n
+		h.count += n
+	}
+	h.sum += sampledSum * scale
+	h.timestamp = time.Now().Unix()
+}
+
+// export sends all recorded metrics. Gauges repeat their last value until
+// the metric is reported again.
+func (oe *OTLPExporter) export() {
+	if oe.agent.OTLPAddress == "" {
+		return
+	}
+
+	oe.exportLock.Lock()
+	defer oe.exportLock.Unlock()
+
+	req := oe.createRequest()
+	if len(req.ResourceMetrics[0].ScopeMetrics[0].Metrics) == 0 {
+		return
+	}
+
+	if err := oe.send(req); err != nil {
+		oe.agent.stats.recordExportFailure(err)
+		oe.agent.warn("Error exporting OTLP metrics")
+		oe.agent.error(err)
+	}
+}
+
+func (oe *OTLPExporter) createRequest() *colmetricspb.ExportMetricsServiceRequest {
+	startTime := uint64(oe.agent.runTs) * uint64(time.Second)
+
+	oe.pointsLock.Lock()
+	defer oe.pointsLock.Unlock()
+
+	// Points of one family share a metric, ordered by name for stable requests.
+	familyNames := make([]string, 0)
+	families := make(map[string]*metricspb.Metric)
+	for _, p := range oe.sortedPoints() {
+		dp := &metricspb.NumberDataPoint{
+			Attributes:   []*commonpb.KeyValue{otlpStringAttribute("name", p.name)},
+			TimeUnixNano: uint64(p.timestamp) * uint64(time.Second),
+			Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: p.value},
+		}
+
+		metric, exists := families[p.familyName]
+		if !exists {
+			metric = &metricspb.Metric{
+				Name: p.familyName,
+				Unit: p.unit,
+			}
+			if p.monotonic {
+				metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					IsMonotonic:            true,
+				}}
+			} else {
+				metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+			}
+			families[p.familyName] = metric
+			familyNames = append(familyNames, p.familyName)
+		}
+
+		if p.monotonic {
+			dp.StartTimeUnixNano = startTime
+			sum := metric.GetSum()
+			sum.DataPoints = append(sum.DataPoints, dp)
+		} else {
+			gauge := metric.GetGauge()
+			gauge.DataPoints = append(gauge.DataPoints, dp)
+		}
+	}
+
+	metrics := make([]*metricspb.Metric, 0, len(familyNames)+1)
+	for _, familyName := range familyNames {
+		metrics = append(metrics, families[familyName])
+	}
+
+	if len(oe.histograms) > 0 {
+		histogram := &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		}
+
+		segments := make([]string, 0, len(oe.histograms))
+		for segment := range oe.histograms {
+			segments = append(segments, segment)
+		}
+		sort.Strings(segments)
+
+		for _, segment := range segments {
+			h := oe.histograms[segment]
+			sum := h.sum
+			histogram.DataPoints = append(histogram.DataPoints, &metricspb.HistogramDataPoint{
+				Attributes:        []*commonpb.KeyValue{otlpStringAttribute("segment", h.segment)},
+				StartTimeUnixNano: startTime,
+				TimeUnixNano:      uint64(h.timestamp) * uint64(time.Second),
+				Count:             h.count,
+				Sum:               &sum,
+				BucketCounts:      append([]uint64(nil), h.bucketCounts...),
+				ExplicitBounds:    h.bounds,
+			})
+		}
+
+		metrics = append(metrics, &metricspb.Metric{
+			Name:        MetricNamespace + "_segment_duration_seconds",
+			Description: "Duration of measured segments. Nested segments are labeled with their path.",
+			Unit:        "s",
+			Data:        &metricspb.Metric_Histogram{Histogram: histogram},
+		})
+	}
+
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{
+			{
+				Resource: oe.resource(),
+				ScopeMetrics: []*metricspb.ScopeMetrics{
+					{
+						Scope: &commonpb.InstrumentationScope{
+							Name:    "github.com/darshanman/profile-agent",
+							Version: AgentVersion,
+						},
+						Metrics: metrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+// sortedPoints returns the points ordered by family and name. It must be
+// called with pointsLock held.
+func (oe *OTLPExporter) sortedPoints() []*otlpPoint {
+	points := make([]*otlpPoint, 0, len(oe.points))
+	for _, p := range oe.points {
+		points = append(points, p)
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].familyName != points[j].familyName {
+			return points[i].familyName < points[j].familyName
+		}
+		return points[i].name < points[j].name
+	})
+
+	return points
+}
+
+func (oe *OTLPExporter) resource() *resourcepb.Resource {
+	attributes := []*commonpb.KeyValue{
+		otlpStringAttribute("service.name", oe.agent.AppName),
+		otlpStringAttribute("service.instance.id", oe.agent.runID),
+		otlpStringAttribute("host.name", oe.agent.HostName),
+		otlpStringAttribute("process.runtime.name", "go"),
+		{Key: "process.pid", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(os.Getpid())}}},
+	}
+
+	if oe.agent.AppVersion != "" {
+		attributes = append(attributes, otlpStringAttribute("service.version", oe.agent.AppVersion))
+	}
+
+	if oe.agent.AppEnvironment != "" {
+		attributes = append(attributes, otlpStringAttribute("deployment.environment.name", oe.agent.AppEnvironment))
+	}
+
+	return &resourcepb.Resource{Attributes: attributes}
+}
+
+func (oe *OTLPExporter) send(req *colmetricspb.ExportMetricsServiceRequest) error {
+	var body []byte
+	var contentType string
+	var err error
+	if oe.agent.OTLPProtocol == OTLPProtocolJSON {
+		body, err = protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(req)
+		contentType = "application/json"
+	} else {
+		body, err = proto.Marshal(req)
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		return err
+	}
+
+	u := oe.agent.OTLPAddress + "/v1/metrics"
+	httpReq, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+
+	oe.agent.log("Exporting OTLP metrics to %v", u)
+
+	httpClient, err := oe.agent.httpClient.get()
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Received %v: %v", res.StatusCode, string(resBody))
+	}
+
+	return nil
+}
+
+func otlpStringAttribute(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+// otlpUnit returns the UCUM unit of a base unit.
+func otlpUnit(baseUnit string) string {
+	switch baseUnit {
+	case "seconds":
+		return "s"
+	case "bytes":
+		return "By"
+	case "ratio":
+		return "1"
+	}
+
+	return ""
+}
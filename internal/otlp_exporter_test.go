@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPExport(t *testing.T) {
+	var path, contentType string
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.AppVersion = "1.0.0"
+	agent.AppEnvironment = "prod"
+	agent.HostName = "Host1"
+	agent.OTLPAddress = server.URL
+
+	gauge := newMetric(agent, TypeState, CategoryMemory, NameCurrentRSS, UnitKilobyte)
+	gauge.createMeasurement(TriggerTimer, 2, 0, nil)
+	agent.otlpExporter.update(gauge)
+
+	counter := newMetric(agent, TypeCounter, CategoryMemory, NameMallocs, UnitNone)
+	counter.createMeasurement(TriggerTimer, 10, 0, nil)
+	counter.createMeasurement(TriggerTimer, 15, 0, nil)
+	agent.otlpExporter.update(counter)
+	counter.createMeasurement(TriggerTimer, 18, 0, nil)
+	agent.otlpExporter.update(counter)
+
+	segment := newBreakdownNode("seg1")
+	segment.updateP95(20)
+	segment.updateP95(200)
+	segment.findOrAddChild("db").updateP95(3000)
+	agent.otlpExporter.observeReservoirs(nil, segment)
+
+	agent.otlpExporter.export()
+
+	if path != "/v1/metrics" || contentType != "application/x-protobuf" {
+		t.Fatalf("Invalid export request: %v %v", path, contentType)
+	}
+
+	rm := req.ResourceMetrics[0]
+	attributes := make(map[string]string)
+	for _, kv := range rm.Resource.Attributes {
+		attributes[kv.Key] = kv.Value.GetStringValue()
+	}
+	if attributes["service.name"] != "App1" || attributes["service.version"] != "1.0.0" ||
+		attributes["deployment.environment.name"] != "prod" || attributes["host.name"] != "Host1" {
+		t.Errorf("Invalid resource attributes: %v", attributes)
+	}
+
+	metrics := make(map[string]*metricspb.Metric)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	rss := metrics["profileagent_memory_bytes"]
+	if rss == nil || rss.Unit != "By" || rss.GetGauge().DataPoints[0].GetAsDouble() != 2048 {
+		t.Errorf("Invalid gauge: %v", rss)
+	}
+
+	mallocs := metrics["profileagent_memory_total"]
+	if mallocs == nil || !mallocs.GetSum().IsMonotonic || mallocs.GetSum().DataPoints[0].GetAsDouble() != 8 {
+		t.Errorf("Invalid sum: %v", mallocs)
+	}
+
+	histogram := metrics["profileagent_segment_duration_seconds"].GetHistogram()
+	if histogram == nil || len(histogram.DataPoints) != 2 {
+		t.Fatalf("Invalid histogram: %v", histogram)
+	}
+
+	dp := histogram.DataPoints[0]
+	if dp.Attributes[0].Value.GetStringValue() != "seg1" || dp.Count != 2 || dp.GetSum() != 0.22 {
+		t.Errorf("Invalid histogram data point: %v", dp)
+	}
+	if histogram.DataPoints[1].Attributes[0].Value.GetStringValue() != "seg1 > db" {
+		t.Errorf("Invalid nested segment: %v", histogram.DataPoints[1])
+	}
+
+	var buckets uint64
+	for _, c := range dp.BucketCounts {
+		buckets += c
+	}
+	if buckets != dp.Count || len(dp.BucketCounts) != len(dp.ExplicitBounds)+1 {
+		t.Errorf("Invalid bucket counts: %v", dp.BucketCounts)
+	}
+}
+
+func TestOTLPExportJSON(t *testing.T) {
+	var contentType string
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := protojson.Unmarshal(body, req); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.OTLPAddress = server.URL
+	agent.OTLPProtocol = OTLPProtocolJSON
+
+	gauge := newMetric(agent, TypeState, CategoryMemory, NameCurrentRSS, UnitKilobyte)
+	gauge.createMeasurement(TriggerTimer, 2, 0, nil)
+	agent.otlpExporter.update(gauge)
+
+	agent.otlpExporter.export()
+
+	if contentType != "application/json" || len(req.ResourceMetrics) != 1 {
+		t.Errorf("Invalid JSON export: %v %v", contentType, req)
+	}
+}
+
+func TestOTLPReservoirScale(t *testing.T) {
+	agent := NewAgent()
+	agent.OTLPAddress = "http://localhost:4318"
+	agent.SegmentBuckets = []float64{0.1, 1}
+
+	agent.otlpExporter.observeReservoir("seg1", []float64{50, 500}, 10)
+
+	h := agent.otlpExporter.histograms["seg1"]
+	if h.count != 10 || h.bucketCounts[0] != 5 || h.bucketCounts[1] != 5 || h.bucketCounts[2] != 0 {
+		t.Errorf("Invalid scaled histogram: %v %v", h.count, h.bucketCounts)
+	}
+}
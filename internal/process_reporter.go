@@ -2,48 +2,79 @@ package internal
 
 import (
 	"runtime"
+	"sync"
 	"time"
 )
 
 //ProcessReporter ...
 type ProcessReporter struct {
-	agent   *Agent
-	metrics map[string]*Metric
+	agent      *Agent
+	metrics    map[string]*Metric
+	reportLock *sync.Mutex
+	stopChan   chan bool
+	runGroup   *sync.WaitGroup
 }
 
 func newProcessReporter(agent *Agent) *ProcessReporter {
 	pr := &ProcessReporter{
-		agent:   agent,
-		metrics: make(map[string]*Metric),
+		agent:      agent,
+		metrics:    make(map[string]*Metric),
+		reportLock: &sync.Mutex{},
+		stopChan:   nil,
+		runGroup:   &sync.WaitGroup{},
 	}
 
 	return pr
 }
 
 func (pr *ProcessReporter) start() {
+	pr.stopChan = make(chan bool)
+	stopChan := pr.stopChan
 
 	delayTimer := time.NewTimer(5 * time.Second)
+	pr.runGroup.Add(1)
 	go func() {
+		defer pr.runGroup.Done()
 		defer pr.agent.recoverAndLog()
 
-		<-delayTimer.C
+		select {
+		case <-delayTimer.C:
+		case <-stopChan:
+			delayTimer.Stop()
+			return
+		}
 
 		pr.report()
+		pr.agent.pushgatewayPusher.push()
+		pr.agent.otlpExporter.export()
 
 		reportTicker := time.NewTicker(60 * time.Second)
-		go func() {
-			defer pr.agent.recoverAndLog()
-
-			for {
-				select {
-				case <-reportTicker.C:
-					pr.report()
-				}
+		defer reportTicker.Stop()
+
+		for {
+			select {
+			case <-reportTicker.C:
+				pr.report()
+				pr.agent.pushgatewayPusher.push()
+				pr.agent.otlpExporter.export()
+			case <-stopChan:
+				return
 			}
-		}()
+		}
 	}()
 }
 
+// stop stops the process reporting and waits for an in-flight report and
+// push to finish.
+func (pr *ProcessReporter) stop() {
+	if pr.stopChan != nil {
+		close(pr.stopChan)
+		pr.stopChan = nil
+	}
+
+	pr.runGroup.Wait()
+}
+
 func (pr *ProcessReporter) reportMetric(typ string, category string, name string, unit string, value float64) *Metric {
 	key := typ + category + name
 	var metric *Metric
@@ -56,14 +87,20 @@ func (pr *ProcessReporter) reportMetric(typ string, category string, name string
 
 	metric.createMeasurement(TriggerTimer, value, 0, nil)
 
-	if metric.hasMeasurement() {
-		pr.agent.messageQueue.addMessage("metric", metric.toMap())
-	}
+	pr.agent.publishMetric(metric)
+	pr.agent.statsdExporter.update(metric)
 
 	return metric
 }
 
 func (pr *ProcessReporter) report() {
+	if !pr.agent.config.isProfilerEnabled(ProfilerProcess) {
+		return
+	}
+
+	pr.reportLock.Lock()
+	defer pr.reportLock.Unlock()
+
 	cpuTime, err := readCPUTime()
 	if err == nil {
 		cpuTimeMetric := pr.reportMetric(TypeCounter, CategoryCPU, NameCPUTime, UnitNanosecond, float64(cpuTime))
@@ -115,4 +152,7 @@ func (pr *ProcessReporter) report() {
 
 	numCgoCall := runtime.NumCgoCall()
 	pr.reportMetric(TypeCounter, CategoryRuntime, NameNumCgoCalls, UnitNone, float64(numCgoCall))
+
+	pr.reportAgentStats()
+	pr.agent.stats.recordReport(ProfilerProcess)
 }
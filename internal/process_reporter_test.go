@@ -30,6 +30,11 @@ func TestReport(t *testing.T) {
 	isValid(t, metrics, TypeState, CategoryGC, NameGCCPUFraction, 0, 1)
 	isValid(t, metrics, TypeState, CategoryRuntime, NameNumGoroutines, 0, math.Inf(0))
 	isValid(t, metrics, TypeCounter, CategoryRuntime, NameNumCgoCalls, 0, math.Inf(0))
+	isValid(t, metrics, TypeCounter, CategoryAgent, NameProfileParseAllocations, 0, math.Inf(0))
+	isValid(t, metrics, TypeState, CategoryAgent, NameMessageQueueSize, 0, math.Inf(0))
+	isValid(t, metrics, TypeCounter, CategoryAgent, NameExportFailures, 0, math.Inf(0))
+	isValid(t, metrics, TypeCounter, CategoryAgent, NameQueueDroppedMessages, 0, math.Inf(0))
+	isValid(t, metrics, TypeCounter, CategoryAgent, NameQueueRetriedMessages, 0, math.Inf(0))
 }
 
 func isValid(t *testing.T, metrics map[string]*Metric, typ string, category string, name string, minValue float64, maxValue float64) {
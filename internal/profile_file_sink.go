@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+//DefaultProfileMaxSize is the default limit of the total size of the files
+// in ProfileDir, 100 MB.
+const DefaultProfileMaxSize int64 = 100 << 20
+
+//DefaultProfileMaxAge is the default age after which profile files are removed.
+const DefaultProfileMaxAge time.Duration = 7 * 24 * time.Hour
+
+// profileFileTimeFormat sorts file names of one profiler by time.
+const profileFileTimeFormat = "20060102T150405.000Z"
+
+var profileFileName = regexp.MustCompile(`^\d{8}T\d{6}\.\d{3}Z_[a-z]+_[0-9a-f]+\.pb\.gz$`)
+
+//ProfileFileSink writes every CPU, block and heap profile read by the
+// reporters as a gzipped pprof file to ProfileDir, e.g.
+// 20261016T101500.000Z_cpu_<runID>.pb.gz, so it can be read with go tool
+// pprof without a backend. After each write, files older than ProfileMaxAge
+// are removed and then the oldest files until the total size is at most
+// ProfileMaxSize. Only files named like profile files are removed, so
+// agents of several runs can share a directory.
+type ProfileFileSink struct {
+	agent     *Agent
+	writeLock *sync.Mutex
+}
+
+func newProfileFileSink(agent *Agent) *ProfileFileSink {
+	pfs := &ProfileFileSink{
+		agent:     agent,
+		writeLock: &sync.Mutex{},
+	}
+
+	return pfs
+}
+
+// write stores a profile read at start by a profiler.
+func (pfs *ProfileFileSink) write(profiler string, start time.Time, p *profile.Profile) {
+	if pfs.agent.ProfileDir == "" {
+		return
+	}
+
+	pfs.writeLock.Lock()
+	defer pfs.writeLock.Unlock()
+
+	fileName, err := pfs.writeFile(profiler, start, p)
+	if err != nil {
+		pfs.agent.stats.recordExportFailure(err)
+		pfs.agent.warn("Error writing %v profile to %v", profiler, pfs.agent.ProfileDir)
+		pfs.agent.error(err)
+		return
+	}
+	pfs.agent.log("Profile written to %v", fileName)
+
+	if err := pfs.rotate(time.Now()); err != nil {
+		pfs.agent.error(err)
+	}
+}
+
+// writeFile writes the profile to a temporary file first, so readers never
+// see partial profiles.
+func (pfs *ProfileFileSink) writeFile(profiler string, start time.Time, p *profile.Profile) (string, error) {
+	if err := os.MkdirAll(pfs.agent.ProfileDir, 0755); err != nil {
+		return "", err
+	}
+
+	name := start.UTC().Format(profileFileTimeFormat) + "_" + profiler + "_" + pfs.agent.runID + ".pb.gz"
+	fileName := filepath.Join(pfs.agent.ProfileDir, name)
+
+	f, err := ioutil.TempFile(pfs.agent.ProfileDir, "."+name+".tmp")
+	if err != nil {
+		return "", err
+	}
+
+	err = p.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+// rotate removes profile files older than ProfileMaxAge, then the oldest
+// files until the total size is within ProfileMaxSize. Zero limits are not
+// enforced.
+func (pfs *ProfileFileSink) rotate(now time.Time) error {
+	infos, err := ioutil.ReadDir(pfs.agent.ProfileDir)
+	if err != nil {
+		return err
+	}
+
+	files := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode().IsRegular() && profileFileName.MatchString(info.Name()) {
+			files = append(files, info)
+		}
+	}
+
+	// Oldest first, by modification time and name.
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].ModTime().Before(files[j].ModTime())
+		}
+		return files[i].Name() < files[j].Name()
+	})
+
+	var totalSize int64
+	for _, f := range files {
+		totalSize += f.Size()
+	}
+
+	for _, f := range files {
+		expired := pfs.agent.ProfileMaxAge > 0 && now.Sub(f.ModTime()) > pfs.agent.ProfileMaxAge
+		oversized := pfs.agent.ProfileMaxSize > 0 && totalSize > pfs.agent.ProfileMaxSize
+		if !expired && !oversized {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(pfs.agent.ProfileDir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		totalSize -= f.Size()
+		pfs.agent.log("Profile file %v removed", f.Name())
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darshanman/profile-agent/internal/pprof/profile"
+)
+
+func TestProfileFileSinkWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := NewAgent()
+	agent.ProfileDir = filepath.Join(dir, "profiles")
+
+	p, err := agent.allocationReporter.readHeapProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 10, 16, 10, 15, 0, 0, time.UTC)
+	agent.publishProfile(ProfilerHeap, start, start, p)
+
+	fileName := filepath.Join(agent.ProfileDir, "20261016T101500.000Z_heap_"+agent.runID+".pb.gz")
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := profile.Parse(f); err != nil {
+		t.Errorf("Written profile cannot be parsed: %v", err)
+	}
+
+	infos, _ := ioutil.ReadDir(agent.ProfileDir)
+	if len(infos) != 1 {
+		t.Errorf("Profile directory should only contain the profile, but has %v files", len(infos))
+	}
+}
+
+func TestProfileFileSinkRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := NewAgent()
+	agent.ProfileDir = dir
+	agent.ProfileMaxSize = 250
+	agent.ProfileMaxAge = time.Hour
+
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{"20261014T000000.000Z_cpu_abc.pb.gz", 2 * time.Hour},
+		{"20261016T000000.000Z_cpu_abc.pb.gz", 30 * time.Minute},
+		{"20261016T000100.000Z_heap_abc.pb.gz", 20 * time.Minute},
+		{"20261016T000200.000Z_block_abc.pb.gz", 10 * time.Minute},
+		{"notes.txt", 3 * time.Hour},
+	}
+	for _, f := range files {
+		fileName := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(fileName, []byte(strings.Repeat("x", 100)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fileName, now.Add(-f.age), now.Add(-f.age))
+	}
+
+	if err := agent.profileFileSink.rotate(now); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, _ := ioutil.ReadDir(dir)
+	remaining := make([]string, 0)
+	for _, info := range infos {
+		remaining = append(remaining, info.Name())
+	}
+
+	// The expired file and the oldest file beyond 250 bytes are removed,
+	// files not named like profiles are kept.
+	expected := "20261016T000100.000Z_heap_abc.pb.gz,20261016T000200.000Z_block_abc.pb.gz,notes.txt"
+	if strings.Join(remaining, ",") != expected {
+		t.Errorf("Invalid files after rotation: %v", remaining)
+	}
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+)
+
+//ProfilerLock is a mutex that can be waited for with a context.
+type ProfilerLock struct {
+	lockChan chan bool
+}
+
+func newProfilerLock() *ProfilerLock {
+	pl := &ProfilerLock{
+		lockChan: make(chan bool, 1),
+	}
+
+	return pl
+}
+
+//Lock ...
+func (pl *ProfilerLock) Lock() {
+	pl.lockChan <- true
+}
+
+//Unlock ...
+func (pl *ProfilerLock) Unlock() {
+	<-pl.lockChan
+}
+
+func (pl *ProfilerLock) lockContext(ctx context.Context) error {
+	select {
+	case pl.lockChan <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"errors"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -11,16 +13,24 @@ type reportFuncType func()
 //ProfilerScheduler ...
 type ProfilerScheduler struct {
 	agent          *Agent
+	name           string
 	randSource     *rand.Rand
 	recordInterval int64
 	recordDuration int64
 	reportInterval int64
 	recordFunc     recordFuncType
 	reportFunc     reportFuncType
+	stopChan       chan bool
+	recordChanged  chan bool
+	reportChanged  chan bool
+	runGroup       *sync.WaitGroup
+	scheduleLock   *sync.Mutex
+	intervalLock   *sync.Mutex
 }
 
 func newProfilerScheduler(
 	agent *Agent,
+	name string,
 	recordInterval int64,
 	recordDuration int64,
 	reportInterval int64,
@@ -29,57 +39,172 @@ func newProfilerScheduler(
 
 	ps := &ProfilerScheduler{
 		agent:          agent,
+		name:           name,
 		randSource:     rand.New(rand.NewSource(time.Now().UnixNano())),
 		recordInterval: recordInterval,
 		recordDuration: recordDuration,
 		reportInterval: reportInterval,
 		recordFunc:     recordFunc,
 		reportFunc:     reportFunc,
+		stopChan:       nil,
+		recordChanged:  make(chan bool, 1),
+		reportChanged:  make(chan bool, 1),
+		runGroup:       &sync.WaitGroup{},
+		scheduleLock:   &sync.Mutex{},
+		intervalLock:   &sync.Mutex{},
 	}
 
 	return ps
 }
 
 func (ps *ProfilerScheduler) start() {
-	if ps.recordFunc != nil {
-		maxDelay := int64(float64(ps.recordInterval - ps.recordDuration))
+	ps.scheduleLock.Lock()
+	defer ps.scheduleLock.Unlock()
+
+	ps.startSchedule()
+}
+
+func (ps *ProfilerScheduler) startSchedule() {
+	ps.stopChan = make(chan bool)
+	stopChan := ps.stopChan
+	recordInterval, _, reportInterval := ps.readIntervals()
 
-		recordIntervalTicker := time.NewTicker(time.Duration(ps.recordInterval) * time.Millisecond)
+	if ps.recordFunc != nil {
+		recordIntervalTicker := time.NewTicker(time.Duration(recordInterval) * time.Millisecond)
+		ps.runGroup.Add(1)
 		go func() {
+			defer ps.runGroup.Done()
 			defer ps.agent.recoverAndLog()
+			defer recordIntervalTicker.Stop()
 
 			for {
 				select {
 				case <-recordIntervalTicker.C:
-					randomTimer := time.NewTimer(time.Duration(ps.randSource.Int63n(maxDelay)) * time.Millisecond)
-					<-randomTimer.C
+					recordInterval, recordDuration, _ := ps.readIntervals()
+					maxDelay := recordInterval - recordDuration
 
-					go ps.executeRecord()
+					randomTimer := time.NewTimer(time.Duration(ps.randSource.Int63n(maxDelay)) * time.Millisecond)
+					select {
+					case <-randomTimer.C:
+					case <-stopChan:
+						randomTimer.Stop()
+						return
+					}
+
+					ps.runGroup.Add(1)
+					go func() {
+						defer ps.runGroup.Done()
+
+						ps.executeRecord(recordDuration)
+					}()
+				case <-ps.recordChanged:
+					recordInterval, _, _ := ps.readIntervals()
+					recordIntervalTicker.Reset(time.Duration(recordInterval) * time.Millisecond)
+				case <-stopChan:
+					return
 				}
 			}
 		}()
 	}
 
-	reportIntervalTicker := time.NewTicker(time.Duration(ps.reportInterval) * time.Millisecond)
+	reportIntervalTicker := time.NewTicker(time.Duration(reportInterval) * time.Millisecond)
+	ps.runGroup.Add(1)
 	go func() {
+		defer ps.runGroup.Done()
 		defer ps.agent.recoverAndLog()
+		defer reportIntervalTicker.Stop()
 
 		for {
 			select {
 			case <-reportIntervalTicker.C:
-				go ps.executeReport()
+				ps.runGroup.Add(1)
+				go func() {
+					defer ps.runGroup.Done()
+
+					ps.executeReport()
+				}()
+			case <-ps.reportChanged:
+				_, _, reportInterval := ps.readIntervals()
+				reportIntervalTicker.Reset(time.Duration(reportInterval) * time.Millisecond)
+			case <-stopChan:
+				return
 			}
 		}
 	}()
 }
 
-func (ps *ProfilerScheduler) executeRecord() {
+// stop stops the tickers and waits for in-flight record and report runs to
+// finish. It does not run a final report.
+func (ps *ProfilerScheduler) stop() {
+	ps.scheduleLock.Lock()
+	defer ps.scheduleLock.Unlock()
+
+	ps.stopSchedule()
+}
+
+func (ps *ProfilerScheduler) stopSchedule() {
+	if ps.stopChan == nil {
+		return
+	}
+
+	close(ps.stopChan)
+	ps.stopChan = nil
+
+	ps.runGroup.Wait()
+}
+
+// setIntervals changes the schedule in milliseconds. A running schedule
+// resets its tickers to the new intervals without waiting for in-flight runs,
+// which finish with the old record duration. recordInterval and
+// recordDuration are ignored for schedulers without a record function.
+func (ps *ProfilerScheduler) setIntervals(recordInterval int64, recordDuration int64, reportInterval int64) error {
+	if reportInterval <= 0 {
+		return errors.New("Report interval must be positive")
+	}
+
+	if ps.recordFunc != nil && (recordDuration <= 0 || recordInterval <= recordDuration) {
+		return errors.New("Record duration must be positive and shorter than record interval")
+	}
+
+	ps.intervalLock.Lock()
+	defer ps.intervalLock.Unlock()
+
+	if ps.recordFunc != nil {
+		ps.recordInterval = recordInterval
+		ps.recordDuration = recordDuration
+		notifyChanged(ps.recordChanged)
+	}
+	ps.reportInterval = reportInterval
+	notifyChanged(ps.reportChanged)
+
+	return nil
+}
+
+// notifyChanged signals a schedule loop without blocking, a pending signal
+// already covers the latest intervals.
+func notifyChanged(changed chan bool) {
+	select {
+	case changed <- true:
+	default:
+	}
+}
+
+func (ps *ProfilerScheduler) readIntervals() (recordInterval int64, recordDuration int64, reportInterval int64) {
+	ps.intervalLock.Lock()
+	defer ps.intervalLock.Unlock()
+
+	return ps.recordInterval, ps.recordDuration, ps.reportInterval
+}
+
+func (ps *ProfilerScheduler) executeRecord(duration int64) {
 	defer ps.agent.recoverAndLog()
 
 	ps.agent.profilerLock.Lock()
 	defer ps.agent.profilerLock.Unlock()
 
-	ps.recordFunc(ps.recordDuration)
+	ps.agent.stats.measureRun(ps.name+" record", func() {
+		ps.recordFunc(duration)
+	})
 }
 
 func (ps *ProfilerScheduler) executeReport() {
@@ -88,5 +213,5 @@ func (ps *ProfilerScheduler) executeReport() {
 	ps.agent.profilerLock.Lock()
 	defer ps.agent.profilerLock.Unlock()
 
-	ps.reportFunc()
+	ps.agent.stats.measureActive(ps.name+" report", ps.reportFunc)
 }
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -9,14 +10,14 @@ func TestTimerReport(t *testing.T) {
 	agent := NewAgent()
 	agent.Debug = true
 
-	recordCount := 0
-	reportCount := 0
-	pt := newProfilerScheduler(agent, 10, 1, 100,
+	var recordCount int32
+	var reportCount int32
+	pt := newProfilerScheduler(agent, "Test profiler", 10, 1, 100,
 		func(duration int64) {
-			recordCount++
+			atomic.AddInt32(&recordCount, 1)
 		},
 		func() {
-			reportCount++
+			atomic.AddInt32(&reportCount, 1)
 		},
 	)
 	pt.start()
@@ -26,11 +27,11 @@ func TestTimerReport(t *testing.T) {
 	go func() {
 		<-testTimer.C
 
-		if recordCount < 5 {
+		if atomic.LoadInt32(&recordCount) < 5 {
 			t.Error("record func was called less than 9 times")
 		}
 
-		if reportCount < 1 {
+		if atomic.LoadInt32(&reportCount) < 1 {
 			t.Error("report func was called less than 1 times")
 		}
 
@@ -38,3 +39,85 @@ func TestTimerReport(t *testing.T) {
 	}()
 	<-done
 }
+
+func TestSetIntervals(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	var reportCount int32
+	pt := newProfilerScheduler(agent, "Test profiler", 10000, 1000, 100000,
+		func(duration int64) {},
+		func() {
+			atomic.AddInt32(&reportCount, 1)
+		},
+	)
+	pt.start()
+	defer pt.stop()
+
+	if err := pt.setIntervals(10, 20, 100); err == nil {
+		t.Error("Record duration longer than record interval should not be accepted")
+	}
+
+	if err := pt.setIntervals(10, 1, 50); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if atomic.LoadInt32(&reportCount) < 1 {
+		t.Error("report func was not called with the new interval")
+	}
+
+	if _, _, reportInterval := pt.readIntervals(); reportInterval != 50 {
+		t.Errorf("Report interval should be 50 but is %v", reportInterval)
+	}
+}
+
+func TestSetIntervalsDuringRecord(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	var lastDuration int64
+	recording := make(chan bool, 1)
+	release := make(chan bool)
+	pt := newProfilerScheduler(agent, "Test profiler", 10, 1, 100000,
+		func(duration int64) {
+			atomic.StoreInt64(&lastDuration, duration)
+			select {
+			case recording <- true:
+			default:
+			}
+			<-release
+		},
+		func() {},
+	)
+	pt.start()
+	defer pt.stop()
+
+	<-recording
+
+	set := make(chan error)
+	go func() {
+		set <- pt.setIntervals(20, 5, 100000)
+	}()
+
+	select {
+	case err := <-set:
+		close(release)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("setIntervals waited for the in-flight record")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&lastDuration) != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Record duration should be 5 but is %v", atomic.LoadInt64(&lastDuration))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+//PushgatewayPusher pushes the metrics of the agent's MetricCollector to a
+// Pushgateway for jobs that exit before they are scraped. The job is the
+// AppName and the grouping label is the HostName as instance, so every run
+// replaces the group of the previous run on the same host instead of
+// leaving stale groups behind.
+type PushgatewayPusher struct {
+	agent    *Agent
+	pushLock *sync.Mutex
+}
+
+func newPushgatewayPusher(agent *Agent) *PushgatewayPusher {
+	pp := &PushgatewayPusher{
+		agent:    agent,
+		pushLock: &sync.Mutex{},
+	}
+
+	return pp
+}
+
+// push replaces the metrics of the agent's group. It is called after
+// process reports and on Stop, after the final reports.
+func (pp *PushgatewayPusher) push() {
+	if pp.agent.PushgatewayAddress == "" {
+		return
+	}
+
+	pp.pushLock.Lock()
+	defer pp.pushLock.Unlock()
+
+	httpClient, err := pp.agent.httpClient.get()
+	if err != nil {
+		pp.agent.error(err)
+		return
+	}
+
+	pp.agent.log("Pushing metrics to %v", pp.agent.PushgatewayAddress)
+
+	err = push.New(pp.agent.PushgatewayAddress, pp.agent.AppName).
+		Client(httpClient).
+		Collector(pp.agent.metricCollector).
+		Grouping("instance", pp.agent.HostName).
+		Push()
+	if err != nil {
+		pp.agent.stats.recordExportFailure(err)
+		pp.agent.warn("Error pushing metrics to Pushgateway")
+		pp.agent.error(err)
+	}
+}
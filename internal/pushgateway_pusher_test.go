@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushgatewayPush(t *testing.T) {
+	var method, path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.HostName = "Host1"
+	agent.Registerer = nil
+	agent.PushgatewayAddress = server.URL
+	agent.metricCollector.start()
+
+	agent.processReporter.report()
+	agent.processReporter.report()
+	agent.pushgatewayPusher.push()
+
+	if method != http.MethodPut || path != "/metrics/job/App1/instance/Host1" {
+		t.Errorf("Invalid push request: %v %v", method, path)
+	}
+
+	// body is protobuf encoded
+	if !strings.Contains(body, "profileagent_memory_bytes") || !strings.Contains(body, "Current RSS") {
+		t.Error("Pushed metrics should contain process metrics")
+	}
+
+	if agent.stats.readExportFailures() != 0 {
+		t.Errorf("Push should not fail, but failed %v times", agent.stats.readExportFailures())
+	}
+}
+
+func TestPushgatewayPushFail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.HostName = "Host1"
+	agent.Registerer = nil
+	agent.PushgatewayAddress = server.URL
+	agent.metricCollector.start()
+
+	agent.pushgatewayPusher.push()
+
+	if agent.stats.readExportFailures() != 1 {
+		t.Errorf("Push failure should be counted, but failures are %v", agent.stats.readExportFailures())
+	}
+}
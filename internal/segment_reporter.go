@@ -9,50 +9,97 @@ import (
 type SegmentReporter struct {
 	agent            *Agent
 	segmentNodes     map[string]*BreakdownNode
+	segmentIDs       map[string]string
 	segmentDurations map[string]*float64
 	recordLock       *sync.RWMutex
+	stopChan         chan bool
+	runGroup         *sync.WaitGroup
 }
 
 func newSegmentReporter(agent *Agent) *SegmentReporter {
 	sr := &SegmentReporter{
 		agent:            agent,
 		segmentNodes:     make(map[string]*BreakdownNode),
+		segmentIDs:       make(map[string]string),
 		segmentDurations: make(map[string]*float64),
 		recordLock:       &sync.RWMutex{},
+		stopChan:         nil,
+		runGroup:         &sync.WaitGroup{},
 	}
 
 	return sr
 }
 
 func (sr *SegmentReporter) start() {
+	sr.stopChan = make(chan bool)
+	stopChan := sr.stopChan
+
 	reportTicker := time.NewTicker(60 * time.Second)
+	sr.runGroup.Add(1)
 	go func() {
+		defer sr.runGroup.Done()
 		defer sr.agent.recoverAndLog()
+		defer reportTicker.Stop()
 
 		for {
 			select {
 			case <-reportTicker.C:
 				sr.report()
+			case <-stopChan:
+				return
 			}
 		}
 	}()
 }
 
+// stop stops the segment reporting and waits for an in-flight report.
+func (sr *SegmentReporter) stop() {
+	if sr.stopChan != nil {
+		close(sr.stopChan)
+		sr.stopChan = nil
+	}
+
+	sr.runGroup.Wait()
+}
+
 func (sr *SegmentReporter) recordSegment(name string, duration float64) {
-	if name == "" {
-		sr.agent.log("Empty segment name")
+	sr.recordSegmentPath([]string{name}, duration)
+}
+
+// recordSegmentPath records a segment nested under the segments in path. The
+// segment tree is keyed by the top-level segment name and every level keeps
+// its own duration reservoir. Durations observed into the histogram carry the
+// ID of the segment's measurement of the current interval as exemplar.
+func (sr *SegmentReporter) recordSegmentPath(path []string, duration float64) {
+	if !sr.agent.config.isProfilerEnabled(ProfilerSegments) {
 		return
 	}
 
+	if len(path) == 0 {
+		sr.agent.log("Empty segment path")
+		return
+	}
+
+	for _, segmentName := range path {
+		if segmentName == "" {
+			sr.agent.log("Empty segment name")
+			return
+		}
+	}
+
+	name := path[0]
+
 	// Segment exists for the current interval.
 	sr.recordLock.RLock()
 	node, nExists := sr.segmentNodes[name]
+	measurementID := sr.segmentIDs[name]
 	if nExists {
-		node.updateP95(duration)
+		updateSegmentPath(node, path[1:], duration)
 	}
 	sr.recordLock.RUnlock()
 
-	// Segment does not exist yet for the current interval.
+	// Segment does not exist yet for the current interval. The node is
+	// updated under the same lock, so report() cannot swap it out in between.
 	if !nExists {
 		sr.recordLock.Lock()
 		node, nExists := sr.segmentNodes[name]
@@ -60,12 +107,18 @@ func (sr *SegmentReporter) recordSegment(name string, duration float64) {
 			// If segment was not created by other recordSegment call between locks, create it.
 			node = newBreakdownNode(name)
 			sr.segmentNodes[name] = node
+			sr.segmentIDs[name] = sr.agent.uuid()
 		}
+		measurementID = sr.segmentIDs[name]
+		updateSegmentPath(node, path[1:], duration)
 		sr.recordLock.Unlock()
+	}
 
-		sr.recordLock.RLock()
-		node.updateP95(duration)
-		sr.recordLock.RUnlock()
+	sr.agent.metricCollector.observeSegment(path, duration, measurementID)
+	sr.agent.statsdExporter.timing(path, duration)
+
+	if len(path) > 1 {
+		return
 	}
 
 	// Save last duration
@@ -84,22 +137,44 @@ func (sr *SegmentReporter) recordSegment(name string, duration float64) {
 	}
 }
 
+func updateSegmentPath(node *BreakdownNode, childPath []string, duration float64) {
+	for _, childName := range childPath {
+		node = node.findOrAddChild(childName)
+	}
+
+	node.updateP95(duration)
+}
+
 func (sr *SegmentReporter) report() {
 	sr.recordLock.Lock()
 	outgoing := sr.segmentNodes
+	outgoingIDs := sr.segmentIDs
 	sr.segmentNodes = make(map[string]*BreakdownNode)
+	sr.segmentIDs = make(map[string]string)
 	sr.recordLock.Unlock()
 
+	if !sr.agent.config.isProfilerEnabled(ProfilerSegments) {
+		return
+	}
+
 	for _, segmentNode := range outgoing {
+		// evaluateP95 resets the reservoirs, so they are exported first.
+		sr.agent.otlpExporter.observeReservoirs(nil, segmentNode)
+
 		segmentRoot := newBreakdownNode("root")
 		segmentRoot.addChild(segmentNode)
 		segmentRoot.evaluateP95()
-		segmentRoot.propagate()
+
+		// Nested segments keep their own P95, so the root takes the
+		// top-level segment's values instead of propagating children.
+		segmentRoot.measurement = segmentNode.measurement
+		segmentRoot.numSamples = segmentNode.numSamples
 
 		metric := newMetric(sr.agent, TypeTrace, CategorySegmentTrace, segmentNode.name, UnitMillisecond)
-		metric.createMeasurement(TriggerTimer, segmentRoot.measurement, 60, segmentRoot)
-		sr.agent.messageQueue.addMessage("metric", metric.toMap())
+		metric.createMeasurementWithID(outgoingIDs[segmentNode.name], TriggerTimer, segmentRoot.measurement, 60, segmentRoot)
+		sr.agent.publishMetric(metric)
 	}
+	sr.agent.stats.recordReport(ProfilerSegments)
 }
 
 func (sr *SegmentReporter) readLastDurations() map[string]float64 {
@@ -55,3 +55,45 @@ func TestReadLastDurations(t *testing.T) {
 		t.Errorf("Duration of seg1 should be 10.3 but is %v", durations["seg1"])
 	}
 }
+
+func TestRecordSegmentPath(t *testing.T) {
+	agent := NewAgent()
+	agent.Debug = true
+
+	for i := 0; i < 10; i++ {
+		agent.segmentReporter.recordSegmentPath([]string{"handler", "db"}, 20)
+		agent.segmentReporter.recordSegmentPath([]string{"handler", "render"}, 5)
+		agent.segmentReporter.recordSegmentPath([]string{"handler"}, 30)
+	}
+
+	handler := agent.segmentReporter.segmentNodes["handler"]
+	if handler == nil {
+		t.Error("handler segment not recorded")
+		return
+	}
+
+	db := handler.findChild("db")
+	render := handler.findChild("render")
+	if db == nil || render == nil {
+		t.Error("nested segments not recorded")
+		return
+	}
+
+	handler.evaluateP95()
+
+	if handler.measurement != 30 {
+		t.Errorf("P95 of handler should be 30 but is %v", handler.measurement)
+	}
+
+	if db.measurement != 20 {
+		t.Errorf("P95 of db should be 20 but is %v", db.measurement)
+	}
+
+	if render.measurement != 5 {
+		t.Errorf("P95 of render should be 5 but is %v", render.measurement)
+	}
+
+	if _, exists := agent.segmentReporter.segmentDurations["db"]; exists {
+		t.Error("Nested segments should not be saved as last durations")
+	}
+}
@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//DefaultStatsDPrefix is the default prefix of StatsD metric names.
+const DefaultStatsDPrefix string = "profileagent"
+
+//DefaultStatsDMaxPacketSize keeps packets within the MTU of common networks
+// after IP and UDP headers.
+const DefaultStatsDMaxPacketSize int = 1432
+
+// statsdBufferSize is the number of lines buffered for the sender. Further
+// lines are dropped until the sender catches up.
+const statsdBufferSize int = 4096
+
+var errStatsDQueueFull = errors.New("StatsD queue is full")
+
+// statsdFlushInterval is the longest time a line waits for more lines to
+// share its packet.
+var statsdFlushInterval = time.Second
+
+//StatsDExporter sends process metrics, segment timings and error counts as
+// StatsD lines over UDP to StatsDAddress:
+//
+//	profileagent.memory.current_rss.bytes:2.4707072e+07|g
+//	profileagent.memory.mallocs:1250|c
+//	profileagent.segment.db_query:12.5|ms
+//	profileagent.errors.handled_exceptions:1|c
+//
+// Gauges carry the last value and counters the delta since the previous
+// report, both in base units. With StatsDDogStatsD, segment and error
+// names are not part of the metric name but tags, e.g.
+// profileagent.segment.duration:12.5|ms|#segment:db query, and all lines are
+// tagged with app, host, version and env plus StatsDTags.
+//
+// Lines are queued without blocking the reporters and batched into packets
+// of at most StatsDMaxPacketSize bytes by a background sender. Lines are
+// dropped if the queue is full and packets if the socket fails; both are
+// counted as export failures.
+type StatsDExporter struct {
+	agent      *Agent
+	lineChan   chan string
+	dropped    int64
+	tags       string
+	stopChan   chan bool
+	senderDone chan bool
+	startLock  *sync.RWMutex
+}
+
+func newStatsDExporter(agent *Agent) *StatsDExporter {
+	se := &StatsDExporter{
+		agent:      agent,
+		lineChan:   nil,
+		dropped:    0,
+		tags:       "",
+		stopChan:   nil,
+		senderDone: nil,
+		startLock:  &sync.RWMutex{},
+	}
+
+	return se
+}
+
+func (se *StatsDExporter) start() {
+	if se.agent.StatsDAddress == "" {
+		return
+	}
+
+	se.startLock.Lock()
+	defer se.startLock.Unlock()
+
+	conn, err := net.Dial("udp", se.agent.StatsDAddress)
+	if err != nil {
+		se.agent.warn("Error connecting to StatsD at %v", se.agent.StatsDAddress)
+		se.agent.error(err)
+		return
+	}
+
+	se.tags = se.constTags()
+	se.lineChan = make(chan string, statsdBufferSize)
+	se.stopChan = make(chan bool)
+	se.senderDone = make(chan bool)
+
+	go se.send(conn, se.lineChan, se.stopChan, se.senderDone)
+}
+
+// stop flushes the queued lines and closes the socket.
+func (se *StatsDExporter) stop() {
+	se.startLock.Lock()
+	defer se.startLock.Unlock()
+
+	if se.stopChan == nil {
+		return
+	}
+
+	close(se.stopChan)
+	<-se.senderDone
+	se.stopChan = nil
+	se.lineChan = nil
+}
+
+// send batches lines into packets. A packet is written when the next line
+// does not fit, on every flush interval and on stop.
+func (se *StatsDExporter) send(conn net.Conn, lineChan chan string, stopChan chan bool, senderDone chan bool) {
+	defer se.agent.recoverAndLog()
+	defer close(senderDone)
+	defer conn.Close()
+
+	maxPacketSize := se.agent.StatsDMaxPacketSize
+	if maxPacketSize <= 0 {
+		maxPacketSize = DefaultStatsDMaxPacketSize
+	}
+
+	var packet bytes.Buffer
+	write := func() {
+		if packet.Len() == 0 {
+			return
+		}
+
+		if _, err := conn.Write(packet.Bytes()); err != nil {
+			se.agent.stats.recordExportFailure(err)
+			se.agent.log("Error sending StatsD packet: %v", err)
+		}
+		packet.Reset()
+	}
+
+	add := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			write()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	flushTicker := time.NewTicker(statsdFlushInterval)
+	defer flushTicker.Stop()
+
+	for {
+		select {
+		case line := <-lineChan:
+			add(line)
+		case <-flushTicker.C:
+			write()
+		case <-stopChan:
+			for {
+				select {
+				case line := <-lineChan:
+					add(line)
+				default:
+					write()
+					return
+				}
+			}
+		}
+	}
+}
+
+// queue adds a line for the sender without blocking.
+func (se *StatsDExporter) queue(name string, value float64, typ string, tags string) {
+	se.startLock.RLock()
+	lineChan := se.lineChan
+	constTags := se.tags
+	se.startLock.RUnlock()
+
+	if lineChan == nil {
+		return
+	}
+
+	line := name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + typ
+	if se.agent.StatsDDogStatsD {
+		if tags != "" && constTags != "" {
+			tags += ","
+		}
+		if tags += constTags; tags != "" {
+			line += "|#" + tags
+		}
+	}
+
+	select {
+	case lineChan <- line:
+	default:
+		if atomic.AddInt64(&se.dropped, 1)%1000 == 1 {
+			se.agent.log("StatsD queue is full, dropping lines")
+		}
+		se.agent.stats.recordExportFailure(errStatsDQueueFull)
+	}
+}
+
+// update sends a process metric as gauge or, for counters, as delta.
+func (se *StatsDExporter) update(m *Metric) {
+	if m.measurement == nil {
+		return
+	}
+
+	unit, factor := baseUnit(m.unit)
+	name := se.prefix() + "." + statsdName(m.category) + "." + statsdName(m.name)
+	if unit != "" {
+		name += "." + unit
+	}
+
+	typ := "g"
+	if m.typ == TypeCounter {
+		typ = "c"
+	}
+
+	se.queue(name, m.measurement.value*factor, typ, "")
+}
+
+// timing sends a segment duration in milliseconds.
+func (se *StatsDExporter) timing(path []string, duration float64) {
+	segment := strings.Join(path, SegmentPathSeparator)
+
+	if se.agent.StatsDDogStatsD {
+		se.queue(se.prefix()+".segment.duration", duration, "ms", "segment:"+statsdTagValue(segment))
+		return
+	}
+
+	names := make([]string, 0, len(path))
+	for _, name := range path {
+		names = append(names, statsdName(name))
+	}
+	se.queue(se.prefix()+".segment."+strings.Join(names, "."), duration, "ms", "")
+}
+
+// incrementError counts an error of a group and class.
+func (se *StatsDExporter) incrementError(group string, class string) {
+	if se.agent.StatsDDogStatsD {
+		se.queue(se.prefix()+".errors", 1, "c", "group:"+statsdTagValue(group)+",class:"+statsdTagValue(class))
+		return
+	}
+
+	se.queue(se.prefix()+".errors."+statsdName(group), 1, "c", "")
+}
+
+func (se *StatsDExporter) prefix() string {
+	if se.agent.StatsDPrefix == "" {
+		return DefaultStatsDPrefix
+	}
+
+	return se.agent.StatsDPrefix
+}
+
+// constTags returns the DogStatsD tags of all lines.
+func (se *StatsDExporter) constTags() string {
+	tags := []string{"app:" + statsdTagValue(se.agent.AppName)}
+	if se.agent.HostName != "" {
+		tags = append(tags, "host:"+statsdTagValue(se.agent.HostName))
+	}
+	if se.agent.AppVersion != "" {
+		tags = append(tags, "version:"+statsdTagValue(se.agent.AppVersion))
+	}
+	if se.agent.AppEnvironment != "" {
+		tags = append(tags, "env:"+statsdTagValue(se.agent.AppEnvironment))
+	}
+	for _, tag := range se.agent.StatsDTags {
+		if tag = statsdTagValue(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return strings.Join(tags, ",")
+}
+
+// statsdName converts a name to lower case with characters other than
+// letters, digits, "-" and "_" replaced by "_", e.g. Current RSS -> current_rss.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, s)
+}
+
+// statsdTagValue removes the separators of the DogStatsD line syntax.
+func statsdTagValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenStatsD(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func readStatsDPackets(conn *net.UDPConn) []string {
+	packets := make([]string, 0)
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestStatsDExport(t *testing.T) {
+	conn := listenStatsD(t)
+	defer conn.Close()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.HostName = "Host1"
+	agent.StatsDAddress = conn.LocalAddr().String()
+	agent.statsdExporter.start()
+
+	gauge := newMetric(agent, TypeState, CategoryMemory, NameCurrentRSS, UnitKilobyte)
+	gauge.createMeasurement(TriggerTimer, 2, 0, nil)
+	agent.statsdExporter.update(gauge)
+
+	counter := newMetric(agent, TypeCounter, CategoryMemory, NameMallocs, UnitNone)
+	counter.createMeasurement(TriggerTimer, 10, 0, nil)
+	agent.statsdExporter.update(counter)
+	counter.createMeasurement(TriggerTimer, 15, 0, nil)
+	agent.statsdExporter.update(counter)
+
+	agent.statsdExporter.timing([]string{"Handler /users", "db query"}, 12.5)
+	agent.statsdExporter.incrementError("Handled exceptions", "timeout")
+
+	agent.statsdExporter.stop()
+
+	packets := readStatsDPackets(conn)
+	expected := "profileagent.memory.current_rss.bytes:2048|g\n" +
+		"profileagent.memory.mallocs:5|c\n" +
+		"profileagent.segment.handler__users.db_query:12.5|ms\n" +
+		"profileagent.errors.handled_exceptions:1|c"
+	if len(packets) != 1 || packets[0] != expected {
+		t.Errorf("Invalid packets: %q", packets)
+	}
+}
+
+func TestStatsDExportDogStatsD(t *testing.T) {
+	conn := listenStatsD(t)
+	defer conn.Close()
+
+	agent := NewAgent()
+	agent.AppName = "App1"
+	agent.HostName = "Host1"
+	agent.StatsDAddress = conn.LocalAddr().String()
+	agent.StatsDDogStatsD = true
+	agent.StatsDTags = []string{"team:core"}
+	agent.statsdExporter.start()
+
+	agent.statsdExporter.timing([]string{"Handler /users", "db query"}, 12.5)
+	agent.statsdExporter.incrementError("Handled exceptions", "a, b")
+
+	agent.statsdExporter.stop()
+
+	lines := strings.Split(strings.Join(readStatsDPackets(conn), "\n"), "\n")
+	if len(lines) != 2 ||
+		lines[0] != "profileagent.segment.duration:12.5|ms|#segment:Handler /users > db query,app:App1,host:Host1,team:core" ||
+		lines[1] != "profileagent.errors:1|c|#group:Handled exceptions,class:a_ b,app:App1,host:Host1,team:core" {
+		t.Errorf("Invalid lines: %q", lines)
+	}
+}
+
+func TestStatsDPacketSize(t *testing.T) {
+	conn := listenStatsD(t)
+	defer conn.Close()
+
+	agent := NewAgent()
+	agent.StatsDAddress = conn.LocalAddr().String()
+	agent.StatsDMaxPacketSize = 100
+	agent.statsdExporter.start()
+
+	for i := 0; i < 20; i++ {
+		agent.statsdExporter.timing([]string{"segment1"}, 10)
+	}
+
+	agent.statsdExporter.stop()
+
+	packets := readStatsDPackets(conn)
+	lines := 0
+	for _, packet := range packets {
+		if len(packet) > 100 {
+			t.Errorf("Packet exceeds max size: %v bytes", len(packet))
+		}
+		lines += len(strings.Split(packet, "\n"))
+	}
+
+	if len(packets) < 2 || lines != 20 {
+		t.Errorf("Lines should be split into packets, but got %v packets with %v lines", len(packets), lines)
+	}
+}
+
+func TestStatsDSocketError(t *testing.T) {
+	conn := listenStatsD(t)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	agent := NewAgent()
+	agent.StatsDAddress = addr
+	agent.statsdExporter.start()
+
+	// Writes to a closed port fail asynchronously, queueing must not block.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2*statsdBufferSize; i++ {
+			agent.statsdExporter.timing([]string{"segment1"}, 10)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queueing lines blocked")
+	}
+
+	agent.statsdExporter.stop()
+
+	if agent.stats.readExportFailures() == 0 {
+		t.Errorf("Dropped lines or packets should be counted")
+	}
+}
@@ -21,3 +21,7 @@ func readCurrentRSS() (int64, error) {
 func readVMSize() (int64, error) {
 	return 0, errors.New("readVMSize is not supported.")
 }
+
+func readThreadCPUTime() (int64, error) {
+	return 0, errors.New("readThreadCPUTime is not supported.")
+}
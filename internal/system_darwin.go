@@ -47,3 +47,7 @@ func readCurrentRSS() (int64, error) {
 func readVMSize() (int64, error) {
 	return 0, errors.New("readVMSize is not supported on OS X")
 }
+
+func readThreadCPUTime() (int64, error) {
+	return 0, errors.New("readThreadCPUTime is not supported on OS X")
+}
@@ -97,3 +97,19 @@ func readVMSize() (int64, error) {
 	return 0, errors.New("Unable to read VM size")
 
 }
+
+func readThreadCPUTime() (int64, error) {
+	rusage := new(syscall.Rusage)
+	if err := syscall.Getrusage(syscall.RUSAGE_THREAD, rusage); err != nil {
+		return 0, err
+	}
+
+	var cpuTimeNanos int64
+	cpuTimeNanos =
+		int64(rusage.Utime.Sec*1e9) +
+			int64(rusage.Utime.Usec*1e3) +
+			int64(rusage.Stime.Sec*1e9) +
+			int64(rusage.Stime.Usec*1e3)
+
+	return cpuTimeNanos, nil
+}
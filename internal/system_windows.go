@@ -43,3 +43,7 @@ func readCurrentRSS() (int64, error) {
 func readVMSize() (int64, error) {
 	return 0, errors.New("readVMSize is not supported on Windows")
 }
+
+func readThreadCPUTime() (int64, error) {
+	return 0, errors.New("readThreadCPUTime is not supported on Windows")
+}
@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//WireVersion is the version of the message format. It is increased on
+// incompatible changes of the payload types, the JSON schema or the
+// protobuf encoding.
+const WireVersion int = 1
+
+//TopicMetric is the topic of messages carrying a MetricPayload.
+const TopicMetric string = "metric"
+
+// wireMaxDepth limits the nesting of decoded breakdown trees.
+const wireMaxDepth int = 1000
+
+//MetricPayload is the wire form of a metric and its last measurement.
+type MetricPayload struct {
+	ID          string              `json:"id"`
+	Type        string              `json:"type"`
+	Category    string              `json:"category"`
+	Name        string              `json:"name"`
+	Unit        string              `json:"unit"`
+	Measurement *MeasurementPayload `json:"measurement,omitempty"`
+}
+
+//MeasurementPayload is the wire form of a measurement. Duration is in
+// seconds and Timestamp a Unix timestamp in seconds.
+type MeasurementPayload struct {
+	ID        string            `json:"id"`
+	Trigger   string            `json:"trigger"`
+	Value     float64           `json:"value"`
+	Duration  int64             `json:"duration"`
+	Timestamp int64             `json:"timestamp"`
+	Breakdown *BreakdownPayload `json:"breakdown,omitempty"`
+}
+
+//BreakdownPayload is the wire form of a breakdown tree, e.g. a call graph.
+// Children are sorted by name.
+type BreakdownPayload struct {
+	Name        string              `json:"name"`
+	Measurement float64             `json:"measurement"`
+	NumSamples  int64               `json:"num_samples"`
+	Children    []*BreakdownPayload `json:"children,omitempty"`
+}
+
+func (bn *BreakdownNode) toPayload() *BreakdownPayload {
+	bn.updateLock.RLock()
+	children := make([]*BreakdownNode, 0, len(bn.children))
+	for _, child := range bn.children {
+		children = append(children, child)
+	}
+	bn.updateLock.RUnlock()
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+
+	bp := &BreakdownPayload{
+		Name:        bn.name,
+		Measurement: bn.measurement,
+		NumSamples:  bn.numSamples,
+		Children:    nil,
+	}
+	for _, child := range children {
+		bp.Children = append(bp.Children, child.toPayload())
+	}
+
+	return bp
+}
+
+func (m *Metric) toPayload() *MetricPayload {
+	mp := &MetricPayload{
+		ID:          m.id,
+		Type:        m.typ,
+		Category:    m.category,
+		Name:        m.name,
+		Unit:        m.unit,
+		Measurement: nil,
+	}
+
+	if m.measurement != nil {
+		mp.Measurement = &MeasurementPayload{
+			ID:        m.measurement.id,
+			Trigger:   m.measurement.trigger,
+			Value:     m.measurement.value,
+			Duration:  m.measurement.duration,
+			Timestamp: m.measurement.timestamp,
+			Breakdown: nil,
+		}
+
+		if m.measurement.breakdown != nil {
+			mp.Measurement.Breakdown = m.measurement.breakdown.toPayload()
+		}
+	}
+
+	return mp
+}
+
+//MarshalMessages encodes messages as the MessageBatch of message.proto.
+// Zero values are omitted, as in proto3.
+func MarshalMessages(messages []Message) []byte {
+	var b []byte
+	for i := range messages {
+		b = appendWireMessage(b, 1, appendMessage(nil, &messages[i]))
+	}
+
+	return b
+}
+
+//UnmarshalMessages decodes a MessageBatch encoded by MarshalMessages.
+// Unknown fields are skipped.
+func UnmarshalMessages(b []byte) ([]Message, error) {
+	messages := make([]Message, 0)
+
+	err := consumeWireFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 || typ != protowire.BytesType {
+			return 0, nil
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+
+		m, err := unmarshalMessage(v)
+		if err != nil {
+			return 0, err
+		}
+		messages = append(messages, m)
+
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func appendMessage(b []byte, m *Message) []byte {
+	b = appendWireVarint(b, 1, uint64(m.Version))
+	b = appendWireString(b, 2, m.Topic)
+	b = appendWireVarint(b, 3, uint64(m.AddedAt))
+	if m.Metric != nil {
+		b = appendWireMessage(b, 4, appendMetric(nil, m.Metric))
+	}
+
+	return b
+}
+
+func appendMetric(b []byte, mp *MetricPayload) []byte {
+	b = appendWireString(b, 1, mp.ID)
+	b = appendWireString(b, 2, mp.Type)
+	b = appendWireString(b, 3, mp.Category)
+	b = appendWireString(b, 4, mp.Name)
+	b = appendWireString(b, 5, mp.Unit)
+	if mp.Measurement != nil {
+		b = appendWireMessage(b, 6, appendMeasurement(nil, mp.Measurement))
+	}
+
+	return b
+}
+
+func appendMeasurement(b []byte, mp *MeasurementPayload) []byte {
+	b = appendWireString(b, 1, mp.ID)
+	b = appendWireString(b, 2, mp.Trigger)
+	b = appendWireDouble(b, 3, mp.Value)
+	b = appendWireVarint(b, 4, uint64(mp.Duration))
+	b = appendWireVarint(b, 5, uint64(mp.Timestamp))
+	if mp.Breakdown != nil {
+		b = appendWireMessage(b, 6, appendBreakdown(nil, mp.Breakdown))
+	}
+
+	return b
+}
+
+func appendBreakdown(b []byte, bp *BreakdownPayload) []byte {
+	b = appendWireString(b, 1, bp.Name)
+	b = appendWireDouble(b, 2, bp.Measurement)
+	b = appendWireVarint(b, 3, uint64(bp.NumSamples))
+	for _, child := range bp.Children {
+		b = appendWireMessage(b, 4, appendBreakdown(nil, child))
+	}
+
+	return b
+}
+
+func unmarshalMessage(b []byte) (Message, error) {
+	var m Message
+
+	err := consumeWireFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Version = int(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.Topic = v
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.AddedAt = int64(v)
+			return n, nil
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			mp, err := unmarshalMetric(v)
+			m.Metric = mp
+			return n, err
+		}
+		return 0, nil
+	})
+
+	return m, err
+}
+
+func unmarshalMetric(b []byte) (*MetricPayload, error) {
+	mp := &MetricPayload{}
+
+	err := consumeWireFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType {
+			return 0, nil
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+
+		switch num {
+		case 1:
+			mp.ID = string(v)
+		case 2:
+			mp.Type = string(v)
+		case 3:
+			mp.Category = string(v)
+		case 4:
+			mp.Name = string(v)
+		case 5:
+			mp.Unit = string(v)
+		case 6:
+			measurement, err := unmarshalMeasurement(v)
+			mp.Measurement = measurement
+			return n, err
+		}
+		return n, nil
+	})
+
+	return mp, err
+}
+
+func unmarshalMeasurement(b []byte) (*MeasurementPayload, error) {
+	mp := &MeasurementPayload{}
+
+	err := consumeWireFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			mp.ID = v
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			mp.Trigger = v
+			return n, nil
+		case num == 3 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			mp.Value = math.Float64frombits(v)
+			return n, nil
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			mp.Duration = int64(v)
+			return n, nil
+		case num == 5 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			mp.Timestamp = int64(v)
+			return n, nil
+		case num == 6 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			bp, err := unmarshalBreakdown(v, 1)
+			mp.Breakdown = bp
+			return n, err
+		}
+		return 0, nil
+	})
+
+	return mp, err
+}
+
+func unmarshalBreakdown(b []byte, depth int) (*BreakdownPayload, error) {
+	if depth > wireMaxDepth {
+		return nil, fmt.Errorf("Breakdown is nested deeper than %v levels", wireMaxDepth)
+	}
+
+	bp := &BreakdownPayload{}
+
+	err := consumeWireFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			bp.Name = v
+			return n, nil
+		case num == 2 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			bp.Measurement = math.Float64frombits(v)
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			bp.NumSamples = int64(v)
+			return n, nil
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			child, err := unmarshalBreakdown(v, depth+1)
+			bp.Children = append(bp.Children, child)
+			return n, err
+		}
+		return 0, nil
+	})
+
+	return bp, err
+}
+
+// consumeWireFields calls field with the value of every field in b. field
+// returns the length of the value it consumed, 0 to skip an unknown field
+// or a negative protowire error code.
+func consumeWireFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if n > len(b) {
+			return errors.New("Field exceeds message")
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+func appendWireVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendWireDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 && !math.Signbit(v) {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendWireString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendWireMessage(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
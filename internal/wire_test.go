@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func testMessage(i int) Message {
+	return Message{
+		Version: WireVersion,
+		Topic:   TopicMetric,
+		Metric: &MetricPayload{
+			ID:          "test",
+			Type:        TypeState,
+			Category:    CategoryAgent,
+			Name:        "test",
+			Measurement: &MeasurementPayload{Value: float64(i)},
+		},
+	}
+}
+
+func testMessageValue(m Message) float64 {
+	if m.Metric == nil || m.Metric.Measurement == nil {
+		return -1
+	}
+
+	return m.Metric.Measurement.Value
+}
+
+func wireJSON(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func newTestBreakdown() *BreakdownNode {
+	root := newBreakdownNode("root")
+	root.measurement = 10
+	root.numSamples = 2
+
+	child := root.findOrAddChild("b")
+	child.measurement = 6
+	child.findOrAddChild("b1").measurement = 6
+	root.findOrAddChild("a").measurement = 4
+
+	return root
+}
+
+func TestBreakdownPayload(t *testing.T) {
+	expected := `{"name":"root","measurement":10,"num_samples":2,"children":[` +
+		`{"name":"a","measurement":4,"num_samples":0},` +
+		`{"name":"b","measurement":6,"num_samples":0,"children":[{"name":"b1","measurement":6,"num_samples":0}]}]}`
+
+	if data := wireJSON(t, newTestBreakdown().toPayload()); data != expected {
+		t.Errorf("Invalid breakdown JSON: %v", data)
+	}
+}
+
+func TestMetricPayload(t *testing.T) {
+	agent := NewAgent()
+
+	m := newMetric(agent, TypeProfile, CategoryCPUProfile, NameCPUUsage, UnitPercent)
+	m.createMeasurementWithID("m1", TriggerTimer, 12.5, 60, newTestBreakdown())
+
+	mp := m.toPayload()
+	if mp.ID != m.id || mp.Type != TypeProfile || mp.Unit != UnitPercent {
+		t.Errorf("Invalid metric payload: %+v", mp)
+	}
+	if mp.Measurement.ID != "m1" || mp.Measurement.Value != 12.5 || mp.Measurement.Duration != 60 {
+		t.Errorf("Invalid measurement payload: %+v", mp.Measurement)
+	}
+	if len(mp.Measurement.Breakdown.Children) != 2 {
+		t.Errorf("Invalid breakdown payload: %+v", mp.Measurement.Breakdown)
+	}
+
+	if mp = newMetric(agent, TypeState, CategoryMemory, NameCurrentRSS, UnitKilobyte).toPayload(); mp.Measurement != nil {
+		t.Errorf("Metric without measurement should have no measurement payload")
+	}
+}
+
+func TestMarshalMessages(t *testing.T) {
+	agent := NewAgent()
+
+	m := newMetric(agent, TypeProfile, CategoryCPUProfile, NameCPUUsage, UnitPercent)
+	m.createMeasurementWithID("m1", TriggerTimer, -12.5, 60, newTestBreakdown())
+
+	messages := []Message{
+		{Version: WireVersion, Topic: TopicMetric, AddedAt: 1760000000, Metric: m.toPayload()},
+		testMessage(0),
+	}
+
+	data := MarshalMessages(messages)
+
+	// Unknown fields of newer versions are skipped.
+	data = protowire.AppendTag(data, 99, protowire.BytesType)
+	data = protowire.AppendString(data, "unknown")
+
+	decoded, err := UnmarshalMessages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, messages) {
+		t.Errorf("Decoded messages differ:\n%v\n%v", wireJSON(t, decoded), wireJSON(t, messages))
+	}
+
+	if len(data) >= len(wireJSON(t, messages)) {
+		t.Errorf("Protobuf encoding should be more compact than JSON")
+	}
+
+	if _, err := UnmarshalMessages(data[:len(data)/2]); err == nil {
+		t.Errorf("Truncated messages should not be decoded")
+	}
+}
+
+// messageProtoDescriptor builds the descriptor of message.proto. It parses
+// the subset of the proto language used by the file: messages with scalar,
+// message and repeated fields.
+func messageProtoDescriptor(t *testing.T) protoreflect.FileDescriptor {
+	data, err := ioutil.ReadFile("../message.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scalarTypes := map[string]descriptorpb.FieldDescriptorProto_Type{
+		"uint32": descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+		"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+		"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	}
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:   proto.String("message.proto"),
+		Syntax: proto.String("proto3"),
+	}
+	var mdp *descriptorpb.DescriptorProto
+	for i, line := range strings.Split(string(data), "\n") {
+		if c := strings.Index(line, "//"); c >= 0 {
+			line = line[:c]
+		}
+		tokens := strings.Fields(strings.Replace(line, ";", " ", -1))
+
+		switch {
+		case len(tokens) == 0:
+		case tokens[0] == "package":
+			fdp.Package = proto.String(tokens[1])
+		case tokens[0] == "message":
+			mdp = &descriptorpb.DescriptorProto{Name: proto.String(tokens[1])}
+			fdp.MessageType = append(fdp.MessageType, mdp)
+		case tokens[0] == "}":
+			mdp = nil
+		case mdp != nil:
+			label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+			if tokens[0] == "repeated" {
+				label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+				tokens = tokens[1:]
+			}
+			if len(tokens) != 4 || tokens[2] != "=" {
+				t.Fatalf("Unsupported field in message.proto line %v: %v", i+1, line)
+			}
+			num, err := strconv.Atoi(tokens[3])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(tokens[1]),
+				JsonName: proto.String(tokens[1]),
+				Number:   proto.Int32(int32(num)),
+				Label:    label.Enum(),
+			}
+			if typ, exists := scalarTypes[tokens[0]]; exists {
+				field.Type = typ.Enum()
+			} else {
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String("." + fdp.GetPackage() + "." + tokens[0])
+			}
+			mdp.Field = append(mdp.Field, field)
+		}
+	}
+
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fd
+}
+
+// hasUnknownFields tells if m or any of its nested messages has fields that
+// are not in its descriptor, e.g. because of a wrong wire type.
+func hasUnknownFields(m protoreflect.Message) bool {
+	if len(m.GetUnknown()) > 0 {
+		return true
+	}
+
+	unknown := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.Message() == nil:
+		case fd.IsList():
+			for i := 0; i < v.List().Len() && !unknown; i++ {
+				unknown = hasUnknownFields(v.List().Get(i).Message())
+			}
+		default:
+			unknown = hasUnknownFields(v.Message())
+		}
+		return !unknown
+	})
+
+	return unknown
+}
+
+func TestMarshalMessagesProto(t *testing.T) {
+	agent := NewAgent()
+
+	m := newMetric(agent, TypeProfile, CategoryCPUProfile, NameCPUUsage, UnitPercent)
+	m.createMeasurementWithID("m1", TriggerTimer, -12.5, 60, newTestBreakdown())
+
+	messages := []Message{
+		{Version: WireVersion, Topic: TopicMetric, AddedAt: 1760000000, Metric: m.toPayload()},
+		testMessage(0),
+	}
+	data := MarshalMessages(messages)
+
+	fd := messageProtoDescriptor(t)
+	batch := dynamicpb.NewMessage(fd.Messages().ByName("MessageBatch"))
+	if err := proto.Unmarshal(data, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if hasUnknownFields(batch) {
+		t.Errorf("Encoded messages have fields that are not in message.proto")
+	}
+
+	field := func(m protoreflect.Message, name string) protoreflect.Value {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+	}
+
+	decoded := field(batch, "messages").List()
+	if decoded.Len() != 2 {
+		t.Fatalf("Expected 2 messages, got %v", decoded.Len())
+	}
+
+	message := decoded.Get(0).Message()
+	metric := field(message, "metric").Message()
+	measurement := field(metric, "measurement").Message()
+	breakdown := field(measurement, "breakdown").Message()
+	children := field(breakdown, "children").List()
+
+	if field(message, "version").Uint() != uint64(WireVersion) || field(message, "added_at").Int() != 1760000000 {
+		t.Errorf("Invalid message fields: %v", message)
+	}
+	if field(metric, "type").String() != TypeProfile || field(metric, "unit").String() != UnitPercent {
+		t.Errorf("Invalid metric fields: %v", metric)
+	}
+	if field(measurement, "value").Float() != -12.5 || field(measurement, "duration").Int() != 60 {
+		t.Errorf("Invalid measurement fields: %v", measurement)
+	}
+	if field(breakdown, "num_samples").Int() != 2 || children.Len() != 2 || field(children.Get(1).Message(), "name").String() != "b" {
+		t.Errorf("Invalid breakdown fields: %v", breakdown)
+	}
+
+	// The decoded messages encode to the same bytes with the generic encoder.
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != string(data) {
+		t.Errorf("Encoding differs from the encoding of message.proto")
+	}
+}
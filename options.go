@@ -0,0 +1,471 @@
+package profileagent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//EnvPrefix - Prefix of environment variables read by LoadOptions.
+const EnvPrefix string = "PROFILE_AGENT_"
+
+//Int - Returns a pointer to v, to set TopFunctions, HTTPMaxRetries and
+// IngestMaxRetries in code.
+func Int(v int) *int {
+	return &v
+}
+
+//Duration - A time.Duration option. Config files give it as a duration
+// string like "30s"; a number is taken as nanoseconds.
+type Duration time.Duration
+
+//String - Returns the duration formatted like time.Duration.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+//MarshalJSON - Encodes the duration as a duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+//UnmarshalJSON - Decodes a duration string or a number of nanoseconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = Duration(n)
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+//MarshalYAML - Encodes the duration as a duration string.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+//UnmarshalYAML - Decodes a duration string or a number of nanoseconds.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var n int64
+	if err := unmarshal(&n); err == nil {
+		*d = Duration(n)
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+//LoadOptions - Returns options with values from the config file and from
+// PROFILE_AGENT_* environment variables applied on top of options.
+//
+// Precedence, from lowest to highest:
+//   1. options passed in code
+//   2. config file (Options.ConfigFile or PROFILE_AGENT_CONFIG_FILE)
+//   3. environment variables
+//
+// Only values that are set in a source override lower precedence values.
+// The config file is JSON if its extension is .json and YAML otherwise;
+// unknown keys are an error in both.
+//
+// Numeric options that are 0 after loading keep the agent's defaults, so a
+// limit, size or duration cannot be set to 0. TopFunctions, HTTPMaxRetries
+// and IngestMaxRetries are pointers that are only applied if set, so 0 turns
+// the top functions or retries off; use Int to set them in code. Boolean
+// options are always applied, so false from a file or environment variable
+// overrides true from code.
+func LoadOptions(options Options) (Options, error) {
+	configFile := options.ConfigFile
+	if v := os.Getenv(EnvPrefix + "CONFIG_FILE"); v != "" {
+		configFile = v
+	}
+
+	if configFile != "" {
+		var err error
+		if options, err = loadOptionsFile(options, configFile); err != nil {
+			return options, err
+		}
+		options.ConfigFile = configFile
+	}
+
+	return loadOptionsEnv(options)
+}
+
+func loadOptionsFile(options Options, fileName string) (Options, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return options, fmt.Errorf("profileagent: cannot read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&options)
+	default:
+		err = yaml.UnmarshalStrict(data, &options)
+	}
+	if err != nil {
+		return options, fmt.Errorf("profileagent: cannot parse config file %v: %v", fileName, err)
+	}
+
+	return options, nil
+}
+
+func loadOptionsEnv(options Options) (Options, error) {
+	stringFields := map[string]*string{
+		"PROXY_ADDRESS":       &options.ProxyAddress,
+		"AGENT_KEY":           &options.AgentKey,
+		"APP_NAME":            &options.AppName,
+		"APP_VERSION":         &options.AppVersion,
+		"APP_ENVIRONMENT":     &options.AppEnvironment,
+		"HOST_NAME":           &options.HostName,
+		"ADMIN_TOKEN":         &options.AdminToken,
+		"PUSHGATEWAY_ADDRESS": &options.PushgatewayAddress,
+		"DASHBOARD_ADDRESS":   &options.DashboardAddress,
+		"SPOOL_DIR":           &options.SpoolDir,
+		"QUEUE_DROP_POLICY":   &options.QueueDropPolicy,
+		"OTLP_ADDRESS":        &options.OTLPAddress,
+		"OTLP_PROTOCOL":       &options.OTLPProtocol,
+		"PROFILE_DIR":         &options.ProfileDir,
+		"INGEST_ADDRESS":      &options.IngestAddress,
+		"STATSD_ADDRESS":      &options.StatsDAddress,
+		"STATSD_PREFIX":       &options.StatsDPrefix,
+		"EXPORT_FILE":         &options.ExportFile,
+		"HTTP_CA_FILE":        &options.HTTPCAFile,
+		"HTTP_CERT_FILE":      &options.HTTPCertFile,
+		"HTTP_KEY_FILE":       &options.HTTPKeyFile,
+		"HTTP_BEARER_TOKEN":   &options.HTTPBearerToken,
+	}
+	for name, field := range stringFields {
+		if v := os.Getenv(EnvPrefix + name); v != "" {
+			*field = v
+		}
+	}
+
+	boolFields := map[string]*bool{
+		"DEBUG":            &options.Debug,
+		"PROFILE_AGENT":    &options.ProfileAgent,
+		"STATSD_DOGSTATSD": &options.StatsDDogStatsD,
+	}
+	for name, field := range boolFields {
+		if v := os.Getenv(EnvPrefix + name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return options, fmt.Errorf("profileagent: invalid value %q of %v%v", v, EnvPrefix, name)
+			}
+			*field = b
+		}
+	}
+
+	intFields := map[string]*int{
+		"QUEUE_MAX_MESSAGES":     &options.QueueMaxMessages,
+		"QUEUE_BATCH_SIZE":       &options.QueueBatchSize,
+		"INGEST_CONCURRENCY":     &options.IngestConcurrency,
+		"STATSD_MAX_PACKET_SIZE": &options.StatsDMaxPacketSize,
+		"EXPORT_FILE_MAX_FILES":  &options.ExportFileMaxFiles,
+	}
+	for name, field := range intFields {
+		if v := os.Getenv(EnvPrefix + name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return options, fmt.Errorf("profileagent: invalid value %q of %v%v", v, EnvPrefix, name)
+			}
+			*field = i
+		}
+	}
+
+	optionalIntFields := map[string]**int{
+		"TOP_FUNCTIONS":      &options.TopFunctions,
+		"INGEST_MAX_RETRIES": &options.IngestMaxRetries,
+		"HTTP_MAX_RETRIES":   &options.HTTPMaxRetries,
+	}
+	for name, field := range optionalIntFields {
+		if v := os.Getenv(EnvPrefix + name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return options, fmt.Errorf("profileagent: invalid value %q of %v%v", v, EnvPrefix, name)
+			}
+			*field = &i
+		}
+	}
+
+	int64Fields := map[string]*int64{
+		"PROFILE_MAX_SIZE":     &options.ProfileMaxSize,
+		"SPOOL_MAX_SIZE":       &options.SpoolMaxSize,
+		"QUEUE_MAX_SIZE":       &options.QueueMaxSize,
+		"EXPORT_FILE_MAX_SIZE": &options.ExportFileMaxSize,
+	}
+	for name, field := range int64Fields {
+		if v := os.Getenv(EnvPrefix + name); v != "" {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return options, fmt.Errorf("profileagent: invalid value %q of %v%v", v, EnvPrefix, name)
+			}
+			*field = i
+		}
+	}
+
+	durationFields := map[string]*Duration{
+		"PROFILE_MAX_AGE": &options.ProfileMaxAge,
+		"HTTP_TIMEOUT":    &options.HTTPTimeout,
+	}
+	for name, field := range durationFields {
+		if v := os.Getenv(EnvPrefix + name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return options, fmt.Errorf("profileagent: invalid value %q of %v%v", v, EnvPrefix, name)
+			}
+			*field = Duration(d)
+		}
+	}
+
+	floatFields := map[string]*float64{
+		"SEGMENT_NATIVE_HISTOGRAM_FACTOR": &options.SegmentNativeHistogramFactor,
+	}
+	for name, field := range floatFields {
+		if v := os.Getenv(EnvPrefix + name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return options, fmt.Errorf("profileagent: invalid value %q of %v%v", v, EnvPrefix, name)
+			}
+			*field = f
+		}
+	}
+
+	// comma separated, e.g. PROFILE_AGENT_SEGMENT_BUCKETS=0.01,0.1,1
+	if v := os.Getenv(EnvPrefix + "SEGMENT_BUCKETS"); v != "" {
+		buckets := make([]float64, 0)
+		for _, b := range strings.Split(v, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+			if err != nil {
+				return options, fmt.Errorf("profileagent: invalid value %q of %vSEGMENT_BUCKETS", v, EnvPrefix)
+			}
+			buckets = append(buckets, f)
+		}
+		options.SegmentBuckets = buckets
+	}
+
+	// comma separated, e.g. PROFILE_AGENT_STATSD_TAGS=team:core,tier:web
+	if v := os.Getenv(EnvPrefix + "STATSD_TAGS"); v != "" {
+		tags := make([]string, 0)
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		options.StatsDTags = tags
+	}
+
+	// comma separated, e.g. PROFILE_AGENT_INGEST_LABELS=region=eu-1,team=core
+	if v := os.Getenv(EnvPrefix + "INGEST_LABELS"); v != "" {
+		labels := make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return options, fmt.Errorf("profileagent: invalid value %q of %vINGEST_LABELS", v, EnvPrefix)
+			}
+			labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		options.IngestLabels = labels
+	}
+
+	// comma separated, e.g. PROFILE_AGENT_HTTP_HEADERS=X-Scope-OrgID=team-1
+	if v := os.Getenv(EnvPrefix + "HTTP_HEADERS"); v != "" {
+		headers := make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return options, fmt.Errorf("profileagent: invalid value %q of %vHTTP_HEADERS", v, EnvPrefix)
+			}
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		options.HTTPHeaders = headers
+	}
+
+	return options, nil
+}
+
+//Validate - Returns an error if options cannot be used to start an agent.
+func (o Options) Validate() error {
+	if strings.TrimSpace(o.AppName) == "" {
+		return errors.New("profileagent: AppName is required")
+	}
+
+	if o.TopFunctions != nil && *o.TopFunctions < 0 {
+		return fmt.Errorf("profileagent: TopFunctions %v must not be negative", *o.TopFunctions)
+	}
+
+	if o.QueueMaxMessages < 0 || o.QueueMaxSize < 0 || o.QueueBatchSize < 0 {
+		return fmt.Errorf("profileagent: QueueMaxMessages %v, QueueMaxSize %v and QueueBatchSize %v must not be negative", o.QueueMaxMessages, o.QueueMaxSize, o.QueueBatchSize)
+	}
+
+	switch o.QueueDropPolicy {
+	case "", QueueDropOldest, QueueDropNewest:
+	default:
+		return fmt.Errorf("profileagent: QueueDropPolicy %q must be %v or %v", o.QueueDropPolicy, QueueDropOldest, QueueDropNewest)
+	}
+
+	if o.SpoolMaxSize < 0 {
+		return fmt.Errorf("profileagent: SpoolMaxSize %v must not be negative", o.SpoolMaxSize)
+	}
+
+	if o.ProfileMaxSize < 0 || o.ProfileMaxAge < 0 {
+		return fmt.Errorf("profileagent: ProfileMaxSize %v and ProfileMaxAge %v must not be negative", o.ProfileMaxSize, o.ProfileMaxAge)
+	}
+
+	if o.IngestConcurrency < 0 {
+		return fmt.Errorf("profileagent: IngestConcurrency %v must not be negative", o.IngestConcurrency)
+	}
+
+	if o.IngestMaxRetries != nil && *o.IngestMaxRetries < 0 {
+		return fmt.Errorf("profileagent: IngestMaxRetries %v must not be negative", *o.IngestMaxRetries)
+	}
+
+	if o.ExportFileMaxSize < 0 || o.ExportFileMaxFiles < 0 {
+		return fmt.Errorf("profileagent: ExportFileMaxSize %v and ExportFileMaxFiles %v must not be negative", o.ExportFileMaxSize, o.ExportFileMaxFiles)
+	}
+
+	if o.HTTPMaxRetries != nil && *o.HTTPMaxRetries < 0 {
+		return fmt.Errorf("profileagent: HTTPMaxRetries %v must not be negative", *o.HTTPMaxRetries)
+	}
+
+	if o.HTTPTimeout < 0 {
+		return fmt.Errorf("profileagent: HTTPTimeout %v must not be negative", o.HTTPTimeout)
+	}
+
+	if (o.HTTPCertFile == "") != (o.HTTPKeyFile == "") {
+		return errors.New("profileagent: HTTPCertFile and HTTPKeyFile must be set together")
+	}
+
+	if o.HTTPCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(o.HTTPCertFile, o.HTTPKeyFile); err != nil {
+			return fmt.Errorf("profileagent: cannot load HTTPCertFile and HTTPKeyFile: %v", err)
+		}
+	}
+
+	if o.HTTPCAFile != "" {
+		pem, err := ioutil.ReadFile(o.HTTPCAFile)
+		if err != nil {
+			return fmt.Errorf("profileagent: cannot read HTTPCAFile: %v", err)
+		}
+
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return fmt.Errorf("profileagent: HTTPCAFile %v has no PEM certificates", o.HTTPCAFile)
+		}
+	}
+
+	if o.StatsDMaxPacketSize < 0 || o.StatsDMaxPacketSize > 65507 {
+		return fmt.Errorf("profileagent: StatsDMaxPacketSize %v must be between 0 and 65507", o.StatsDMaxPacketSize)
+	}
+
+	if o.StatsDAddress != "" {
+		if _, _, err := net.SplitHostPort(o.StatsDAddress); err != nil {
+			return fmt.Errorf("profileagent: StatsDAddress %q must be host:port: %v", o.StatsDAddress, err)
+		}
+	}
+
+	for i := 1; i < len(o.SegmentBuckets); i++ {
+		if o.SegmentBuckets[i] <= o.SegmentBuckets[i-1] {
+			return fmt.Errorf("profileagent: SegmentBuckets %v must be in increasing order", o.SegmentBuckets)
+		}
+	}
+
+	if o.SegmentNativeHistogramFactor != 0 && o.SegmentNativeHistogramFactor <= 1 {
+		return fmt.Errorf("profileagent: SegmentNativeHistogramFactor %v must be greater than 1", o.SegmentNativeHistogramFactor)
+	}
+
+	if err := validateURL("DashboardAddress", o.DashboardAddress); err != nil {
+		return err
+	}
+
+	if err := validateURL("PushgatewayAddress", o.PushgatewayAddress); err != nil {
+		return err
+	}
+
+	if err := validateURL("OTLPAddress", o.OTLPAddress); err != nil {
+		return err
+	}
+
+	switch o.OTLPProtocol {
+	case "", OTLPProtocolProtobuf, OTLPProtocolJSON:
+	default:
+		return fmt.Errorf("profileagent: OTLPProtocol %q must be %v or %v", o.OTLPProtocol, OTLPProtocolProtobuf, OTLPProtocolJSON)
+	}
+
+	if err := validateURL("IngestAddress", o.IngestAddress); err != nil {
+		return err
+	}
+
+	if o.ProxyAddress != "" {
+		u, err := url.Parse(o.ProxyAddress)
+		if err != nil {
+			return fmt.Errorf("profileagent: invalid ProxyAddress: %v", err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("profileagent: ProxyAddress %q must use http, https or socks5 scheme", o.ProxyAddress)
+		}
+
+		if u.Host == "" {
+			return fmt.Errorf("profileagent: ProxyAddress %q has no host", o.ProxyAddress)
+		}
+	}
+
+	return nil
+}
+
+// validateURL returns an error if value is set and is not an http or https
+// URL with a host.
+func validateURL(name string, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("profileagent: invalid %v: %v", name, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("profileagent: %v %q must be an http or https URL", name, value)
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package profileagent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	if err := (Options{}).Validate(); err == nil {
+		t.Error("Empty AppName should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", ProxyAddress: "://proxy"}).Validate(); err == nil {
+		t.Error("Invalid ProxyAddress should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", ProxyAddress: "ftp://proxy:21"}).Validate(); err == nil {
+		t.Error("ProxyAddress with unsupported scheme should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", TopFunctions: Int(-1)}).Validate(); err == nil {
+		t.Error("Negative TopFunctions should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", SegmentBuckets: []float64{1, 0.5}}).Validate(); err == nil {
+		t.Error("Unsorted SegmentBuckets should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", SegmentNativeHistogramFactor: 0.5}).Validate(); err == nil {
+		t.Error("SegmentNativeHistogramFactor below 1 should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", PushgatewayAddress: "pushgateway:9091"}).Validate(); err == nil {
+		t.Error("PushgatewayAddress without scheme should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", DashboardAddress: "ftp://dashboard"}).Validate(); err == nil {
+		t.Error("DashboardAddress with a non-http scheme should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", OTLPAddress: "http://collector:4318", OTLPProtocol: "grpc"}).Validate(); err == nil {
+		t.Error("Unsupported OTLPProtocol should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", QueueDropPolicy: "drop-random"}).Validate(); err == nil {
+		t.Error("Unknown QueueDropPolicy should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", ExportFileMaxFiles: -1}).Validate(); err == nil {
+		t.Error("Negative ExportFileMaxFiles should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", HTTPCertFile: "client.pem"}).Validate(); err == nil {
+		t.Error("HTTPCertFile without HTTPKeyFile should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", HTTPCAFile: "/nonexistent/ca.pem"}).Validate(); err == nil {
+		t.Error("Unreadable HTTPCAFile should not be valid")
+	}
+
+	if err := (Options{AppName: "App1", ProxyAddress: "http://proxy:3128"}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	yamlFile := filepath.Join(dir, "agent.yaml")
+	ioutil.WriteFile(yamlFile, []byte("app_name: FileApp\napp_version: 2.0.0\ndebug: true\nprofile_max_age: 72h\n"), 0644)
+
+	jsonFile := filepath.Join(dir, "agent.json")
+	ioutil.WriteFile(jsonFile, []byte(`{"app_environment": "staging"}`), 0644)
+
+	os.Setenv("PROFILE_AGENT_APP_NAME", "EnvApp")
+	defer os.Unsetenv("PROFILE_AGENT_APP_NAME")
+
+	options, err := LoadOptions(Options{
+		AppName:    "CodeApp",
+		AppVersion: "1.0.0",
+		HostName:   "Host1",
+		ConfigFile: yamlFile,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if options.AppName != "EnvApp" {
+		t.Errorf("AppName should be taken from environment, but is %v", options.AppName)
+	}
+
+	if options.AppVersion != "2.0.0" || !options.Debug {
+		t.Errorf("AppVersion and Debug should be taken from config file, but are %v, %v", options.AppVersion, options.Debug)
+	}
+
+	if options.HostName != "Host1" {
+		t.Errorf("HostName should be kept from code, but is %v", options.HostName)
+	}
+
+	if options.ProfileMaxAge != Duration(72*time.Hour) {
+		t.Errorf("ProfileMaxAge should be parsed as duration, but is %v", options.ProfileMaxAge)
+	}
+
+	os.Setenv("PROFILE_AGENT_CONFIG_FILE", jsonFile)
+	defer os.Unsetenv("PROFILE_AGENT_CONFIG_FILE")
+
+	options, err = LoadOptions(Options{AppName: "CodeApp", ConfigFile: yamlFile})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if options.AppEnvironment != "staging" || options.AppVersion != "" {
+		t.Errorf("Config file should be taken from environment, but options are %v", options)
+	}
+
+	os.Setenv("PROFILE_AGENT_TOP_FUNCTIONS", "5")
+	defer os.Unsetenv("PROFILE_AGENT_TOP_FUNCTIONS")
+
+	if options, _ = LoadOptions(Options{AppName: "CodeApp", TopFunctions: Int(10)}); options.TopFunctions == nil || *options.TopFunctions != 5 {
+		t.Errorf("TopFunctions should be taken from environment, but is %v", options.TopFunctions)
+	}
+
+	os.Setenv("PROFILE_AGENT_INGEST_LABELS", "region=eu-1, team=core")
+	defer os.Unsetenv("PROFILE_AGENT_INGEST_LABELS")
+
+	if options, _ = LoadOptions(Options{AppName: "CodeApp"}); options.IngestLabels["region"] != "eu-1" || options.IngestLabels["team"] != "core" {
+		t.Errorf("IngestLabels should be taken from environment, but are %v", options.IngestLabels)
+	}
+
+	os.Setenv("PROFILE_AGENT_HTTP_HEADERS", "X-Scope-OrgID=team-1")
+	defer os.Unsetenv("PROFILE_AGENT_HTTP_HEADERS")
+
+	if options, _ = LoadOptions(Options{AppName: "CodeApp"}); options.HTTPHeaders["X-Scope-OrgID"] != "team-1" {
+		t.Errorf("HTTPHeaders should be taken from environment, but are %v", options.HTTPHeaders)
+	}
+
+	os.Setenv("PROFILE_AGENT_SEGMENT_BUCKETS", "0.01, 0.1,1")
+	defer os.Unsetenv("PROFILE_AGENT_SEGMENT_BUCKETS")
+
+	if options, _ = LoadOptions(Options{AppName: "CodeApp"}); len(options.SegmentBuckets) != 3 || options.SegmentBuckets[1] != 0.1 {
+		t.Errorf("SegmentBuckets should be taken from environment, but are %v", options.SegmentBuckets)
+	}
+
+	ioutil.WriteFile(jsonFile, []byte(`{"app_nam": "Typo"}`), 0644)
+
+	if _, err := LoadOptions(Options{AppName: "CodeApp"}); err == nil {
+		t.Error("Unknown config file key should fail")
+	}
+
+	os.Setenv("PROFILE_AGENT_DEBUG", "maybe")
+	defer os.Unsetenv("PROFILE_AGENT_DEBUG")
+
+	if _, err := LoadOptions(Options{AppName: "CodeApp"}); err == nil {
+		t.Error("Invalid boolean environment variable should fail")
+	}
+}
+
+func TestApplyOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profileagent")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	jsonFile := filepath.Join(dir, "agent.json")
+	ioutil.WriteFile(jsonFile, []byte(`{"http_timeout": "30s", "profile_max_age": 3600000000000, "top_functions": 0, "http_max_retries": 0}`), 0644)
+
+	os.Setenv("PROFILE_AGENT_DEBUG", "false")
+	defer os.Unsetenv("PROFILE_AGENT_DEBUG")
+
+	agent := NewAgent()
+	agent.internalAgent.Debug = true
+
+	if err := agent.applyOptions(Options{AppName: "App1", Debug: true, IngestMaxRetries: Int(0), ConfigFile: jsonFile}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ia := agent.internalAgent
+	if ia.HTTPTimeout != 30*time.Second || ia.ProfileMaxAge != time.Hour {
+		t.Errorf("Durations should be parsed from string and nanoseconds, but are %v, %v", ia.HTTPTimeout, ia.ProfileMaxAge)
+	}
+
+	if ia.TopFunctions != 0 || ia.HTTPMaxRetries != 0 || ia.IngestMaxRetries != 0 {
+		t.Errorf("Explicit 0 should override defaults, but TopFunctions, HTTPMaxRetries and IngestMaxRetries are %v, %v, %v", ia.TopFunctions, ia.HTTPMaxRetries, ia.IngestMaxRetries)
+	}
+
+	if ia.Debug {
+		t.Error("Debug=false from environment should override Debug from code")
+	}
+
+	ioutil.WriteFile(jsonFile, []byte(`{"http_timeout": "30 seconds"}`), 0644)
+
+	if _, err := LoadOptions(Options{AppName: "App1", ConfigFile: jsonFile}); err == nil {
+		t.Error("Invalid duration should fail")
+	}
+}
@@ -1,21 +1,33 @@
 package profileagent
 
 import (
+	"context"
 	"time"
 )
 
+type segmentContextKey struct{}
+
 //Segment ...
 type Segment struct {
 	agent     *Agent
 	Name      string
+	path      []string
 	startTime time.Time
 	Duration  float64
 }
 
-func newSegment(agent *Agent, name string) *Segment {
+func newSegment(agent *Agent, parent *Segment, name string) *Segment {
+	path := []string{name}
+	if parent != nil {
+		path = make([]string, 0, len(parent.path)+1)
+		path = append(path, parent.path...)
+		path = append(path, name)
+	}
+
 	s := &Segment{
 		agent:    agent,
 		Name:     name,
+		path:     path,
 		Duration: 0,
 	}
 
@@ -30,5 +42,14 @@ func (s *Segment) start() {
 func (s *Segment) Stop() {
 	s.Duration = float64(time.Since(s.startTime).Nanoseconds()) / 1e6
 
-	s.agent.internalAgent.RecordSegment(s.Name, s.Duration)
+	s.agent.internalAgent.RecordSegmentPath(s.path, s.Duration)
+}
+
+func segmentFromContext(ctx context.Context) *Segment {
+	if ctx == nil {
+		return nil
+	}
+
+	s, _ := ctx.Value(segmentContextKey{}).(*Segment)
+	return s
 }
@@ -0,0 +1,44 @@
+package profileagent
+
+import (
+	_ "embed"
+
+	"github.com/darshanman/profile-agent/internal"
+)
+
+//WireVersion - Version of the message format, set in Message.Version. It is
+// increased on incompatible changes.
+const WireVersion = internal.WireVersion
+
+//TopicMetric - Topic of messages carrying a MetricPayload.
+const TopicMetric = internal.TopicMetric
+
+//MetricPayload - A metric and its last measurement.
+type MetricPayload = internal.MetricPayload
+
+//MeasurementPayload - A measurement with an optional breakdown, e.g. the
+// call graph of a profile.
+type MeasurementPayload = internal.MeasurementPayload
+
+//BreakdownPayload - A node of a breakdown tree with its children sorted
+// by name.
+type BreakdownPayload = internal.BreakdownPayload
+
+//go:embed message.schema.json
+var messageSchema []byte
+
+//MessageSchema - Returns the JSON schema of a Message in version
+// WireVersion.
+func MessageSchema() []byte {
+	return append([]byte(nil), messageSchema...)
+}
+
+//MarshalMessages - Encodes messages as the MessageBatch of message.proto.
+func MarshalMessages(messages []Message) []byte {
+	return internal.MarshalMessages(messages)
+}
+
+//UnmarshalMessages - Decodes a MessageBatch of message.proto.
+func UnmarshalMessages(data []byte) ([]Message, error) {
+	return internal.UnmarshalMessages(data)
+}
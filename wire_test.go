@@ -0,0 +1,82 @@
+package profileagent
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkSchema checks that a decoded JSON document only has properties of
+// schema and all its required ones.
+func checkSchema(t *testing.T, root map[string]interface{}, schema map[string]interface{}, doc interface{}, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema = root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+	}
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		properties := schema["properties"].(map[string]interface{})
+		for name, value := range v {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				t.Errorf("%v.%v is not in the schema", path, name)
+				continue
+			}
+			checkSchema(t, root, property, value, path+"."+name)
+		}
+		for _, name := range schema["required"].([]interface{}) {
+			if _, ok := v[name.(string)]; !ok {
+				t.Errorf("%v.%v is required by the schema", path, name)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			checkSchema(t, root, schema["items"].(map[string]interface{}), item, path+"[]")
+		}
+	}
+}
+
+func TestMessageSchema(t *testing.T) {
+	message := Message{
+		Version: WireVersion,
+		Topic:   TopicMetric,
+		AddedAt: 1760000000,
+		Metric: &MetricPayload{
+			ID:       "m1",
+			Type:     "profile",
+			Category: "cpu-profile",
+			Name:     "CPU usage",
+			Unit:     "percent",
+			Measurement: &MeasurementPayload{
+				ID:        "s1",
+				Trigger:   "timer",
+				Value:     12.5,
+				Timestamp: 1760000000,
+				Breakdown: &BreakdownPayload{
+					Name:     "root",
+					Children: []*BreakdownPayload{{Name: "main.work", Measurement: 12.5, NumSamples: 3}},
+				},
+			},
+		},
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(MessageSchema(), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(message)
+	var doc interface{}
+	json.Unmarshal(data, &doc)
+
+	checkSchema(t, schema, schema, doc, "message")
+
+	decoded, err := UnmarshalMessages(MarshalMessages([]Message{message}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, []Message{message}) {
+		t.Errorf("Decoded message differs: %+v", decoded)
+	}
+}